@@ -0,0 +1,210 @@
+package shadowd
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Access list results.
+const (
+	ACL_NONE  = 0
+	ACL_ALLOW = 1
+	ACL_DENY  = 2
+)
+
+// An allow and deny list of client networks, exact paths and path prefixes
+// that is evaluated in-process before a request is sent to shadowd.
+// Allowed requests skip the analysis and denied requests are blocked
+// locally. When an entry matches both lists the deny list wins.
+// Paths are compared case-sensitively against the path as decoded by
+// net/url and its normalized form, with its escapes decoded and its dot
+// segments and repeated slashes removed, see NormalizePath. Deny entries
+// match either form and allow entries only both, so "/healthz/%2e%2e/admin"
+// is not allowed by "/healthz" and "/admin/%252e%252e/healthz" neither.
+//
+// The file format is one entry per line, "allow" or "deny" followed by
+// an IP address, a CIDR, an exact path or a path prefix ending with "*":
+//
+//	# monitoring hosts
+//	allow 10.1.2.0/24
+//	allow 2001:db8::/32
+//	allow /healthz
+//	deny 192.0.2.15
+//	deny /wp-admin/*
+type AccessList struct {
+	Filename string
+
+	mutex sync.RWMutex
+	allow accessEntries
+	deny  accessEntries
+}
+
+type accessEntries struct {
+	nets     []*net.IPNet
+	paths    map[string]bool
+	prefixes []string
+}
+
+// Returns an empty access list.
+func NewAccessList() *AccessList {
+	return &AccessList{}
+}
+
+// Reads an access list from a file, the file can later be re-read with Reload.
+func LoadAccessList(filename string) (*AccessList, error) {
+	acl := &AccessList{Filename: filename}
+	err := acl.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// Re-reads the access list file and replaces the current entries.
+// On error the current entries are kept.
+func (acl *AccessList) Reload() error {
+	file, err := os.Open(acl.Filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var allow, deny accessEntries
+	scanner := bufio.NewScanner(file)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: expected \"allow|deny entry\"", acl.Filename, lineno)
+		}
+		switch fields[0] {
+		case "allow":
+			err = allow.add(fields[1])
+		case "deny":
+			err = deny.add(fields[1])
+		default:
+			err = fmt.Errorf("unknown action %q", fields[0])
+		}
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", acl.Filename, lineno, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	acl.mutex.Lock()
+	acl.allow, acl.deny = allow, deny
+	acl.mutex.Unlock()
+	return nil
+}
+
+// Adds an IP, CIDR, path or path prefix to the allow list.
+func (acl *AccessList) Allow(entry string) error {
+	acl.mutex.Lock()
+	defer acl.mutex.Unlock()
+	return acl.allow.add(entry)
+}
+
+// Adds an IP, CIDR, path or path prefix to the deny list.
+func (acl *AccessList) Deny(entry string) error {
+	acl.mutex.Lock()
+	defer acl.mutex.Unlock()
+	return acl.deny.add(entry)
+}
+
+// Evaluates the request against the lists and returns one of the ACL_X values.
+// A nil access list always returns ACL_NONE.
+func (acl *AccessList) Check(req *http.Request) int {
+	if acl == nil {
+		return ACL_NONE
+	}
+	ip := net.ParseIP(ClientIP(req))
+
+	acl.mutex.RLock()
+	defer acl.mutex.RUnlock()
+	if acl.deny.matchesIP(ip) || matchRequestPath(req, false, acl.deny.matchesPath) {
+		return ACL_DENY
+	}
+	if acl.allow.matchesIP(ip) || matchRequestPath(req, true, acl.allow.matchesPath) {
+		return ACL_ALLOW
+	}
+	return ACL_NONE
+}
+
+func (entries *accessEntries) add(entry string) error {
+	switch {
+	case strings.HasPrefix(entry, "/") && strings.HasSuffix(entry, "*"):
+		entries.prefixes = append(entries.prefixes, strings.TrimSuffix(entry, "*"))
+	case strings.HasPrefix(entry, "/"):
+		if entries.paths == nil {
+			entries.paths = make(map[string]bool)
+		}
+		entries.paths[entry] = true
+	case strings.Contains(entry, "/"):
+		_, ipnet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return err
+		}
+		entries.nets = append(entries.nets, ipnet)
+	default:
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return fmt.Errorf("invalid IP address %q", entry)
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 32
+		}
+		entries.nets = append(entries.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return nil
+}
+
+func (entries *accessEntries) matchesPath(path string) bool {
+	if entries.paths[path] {
+		return true
+	}
+	for _, prefix := range entries.prefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (entries *accessEntries) matchesIP(ip net.IP) bool {
+	if ip != nil {
+		for _, ipnet := range entries.nets {
+			if ipnet.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the client IP address of the request.
+// The RemoteAddr may be an "ip:port", a bracketed IPv6 "[ip]:port" or a
+// plain IP as set by proxies such as the ICAP example.
+func ClientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = strings.Trim(req.RemoteAddr, "[]")
+	}
+	if zone := strings.IndexByte(host, '%'); zone >= 0 {
+		host = host[:zone]
+	}
+	return host
+}
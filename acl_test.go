@@ -0,0 +1,69 @@
+package shadowd
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAccessListCheck(t *testing.T) {
+	acl := NewAccessList()
+	for _, entry := range []string{"/healthz*", "10.1.2.0/24"} {
+		if err := acl.Allow(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, entry := range []string{"/admin/*", "192.0.2.15"} {
+		if err := acl.Deny(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		remote string
+		target string
+		want   int
+	}{
+		{"198.51.100.1:1234", "/healthz", ACL_ALLOW},
+		{"198.51.100.1:1234", "/admin/x", ACL_DENY},
+		{"198.51.100.1:1234", "/healthz/%2e%2e/admin/x", ACL_DENY},
+		{"198.51.100.1:1234", "/healthz/../admin/x", ACL_DENY},
+		{"198.51.100.1:1234", "//admin/x", ACL_DENY},
+		{"198.51.100.1:1234", "/healthz%5c..%5cadmin/x", ACL_DENY},
+		{"198.51.100.1:1234", "/other", ACL_NONE},
+		{"10.1.2.3:1234", "/other", ACL_ALLOW},
+		{"10.1.2.3:1234", "/admin/x", ACL_DENY},
+		{"192.0.2.15:1234", "/healthz", ACL_DENY},
+		{"198.51.100.1:1234", "/api/%252e%252e/healthz", ACL_NONE},
+		{"198.51.100.1:1234", "/api/%2e%2e/healthz", ACL_NONE},
+		{"198.51.100.1:1234", "/api/%252e%252e/admin/x", ACL_DENY},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "http://example.com"+test.target, nil)
+		req.RemoteAddr = test.remote
+		if got := acl.Check(req); got != test.want {
+			t.Errorf("Check(%s, %s) = %d, want %d", test.remote, test.target, got, test.want)
+		}
+	}
+}
+
+func TestAccessListAllowNeedsBothPaths(t *testing.T) {
+	acl := NewAccessList()
+	if err := acl.Allow("/healthz"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		target string
+		want   int
+	}{
+		{"/healthz", ACL_ALLOW},
+		{"/admin/%252e%252e/healthz", ACL_NONE},
+		{"/admin/%2e%2e/healthz", ACL_NONE},
+		{"//healthz", ACL_NONE},
+		{"/HEALTHZ", ACL_NONE},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "http://example.com"+test.target, nil)
+		if got := acl.Check(req); got != test.want {
+			t.Errorf("Check(%s) = %d, want %d", test.target, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package shadowd
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The value written instead of redacted inputs.
+const AUDIT_REDACTED = "[redacted]"
+
+// A Sink writing one json line per check to Filename.
+// The file is rotated when it grows beyond MaxSize bytes or gets older than
+// MaxAge, zero disables the matching limit. Rotated files are renamed with
+// a timestamp suffix, gzip compressed when Compress is set, and only the
+// newest MaxBackups are kept (zero keeps all).
+// Inputs whose key equals or matches a glob in Redact, such as
+// "SERVER|HTTP_AUTHORIZATION" or "COOKIE|*", are written as AUDIT_REDACTED,
+// as are their "NORMALIZED|" copies.
+type AuditLog struct {
+	Filename   string
+	MaxSize    int64
+	MaxAge     time.Duration
+	MaxBackups int
+	Compress   bool
+	Redact     []string
+
+	mutex         sync.Mutex
+	rotationMutex sync.Mutex
+	file          *os.File
+	size          int64
+	opened        time.Time
+}
+
+// Opens, or creates, the audit log file for appending.
+func NewAuditLog(filename string) (*AuditLog, error) {
+	audit := &AuditLog{Filename: filename}
+	err := audit.open()
+	if err != nil {
+		return nil, err
+	}
+	return audit, nil
+}
+
+// Writes the event as a json line, rotating the file when needed.
+func (audit *AuditLog) HandleEvent(event *Event) {
+	record := *event
+	if len(audit.Redact) > 0 && len(event.Inputs) > 0 {
+		record.Inputs = make(map[string]string, len(event.Inputs))
+		for k, v := range event.Inputs {
+			if audit.redacted(k) {
+				v = AUDIT_REDACTED
+			}
+			record.Inputs[k] = v
+		}
+	}
+	line, err := json.Marshal(&record)
+	if err != nil {
+		fmt.Println("Error marshaling the audit record:", err)
+		return
+	}
+	line = append(line, '\n')
+
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+	if audit.file == nil {
+		if err := audit.open(); err != nil {
+			fmt.Println("Error opening the audit log:", err)
+			return
+		}
+	}
+	if (audit.MaxSize > 0 && audit.size+int64(len(line)) > audit.MaxSize && audit.size > 0) ||
+		(audit.MaxAge > 0 && time.Since(audit.opened) > audit.MaxAge) {
+		if err := audit.rotate(); err != nil {
+			fmt.Println("Error rotating the audit log:", err)
+		}
+	}
+	n, err := audit.file.Write(line)
+	audit.size += int64(n)
+	if err != nil {
+		fmt.Println("Error writing the audit log:", err)
+	}
+}
+
+// Rotates the audit log now.
+func (audit *AuditLog) Rotate() error {
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+	return audit.rotate()
+}
+
+// Closes the audit log file.
+func (audit *AuditLog) Close() error {
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+	if audit.file == nil {
+		return nil
+	}
+	err := audit.file.Close()
+	audit.file = nil
+	return err
+}
+
+func (audit *AuditLog) redacted(key string) bool {
+	if normalized := strings.TrimPrefix(key, "NORMALIZED|"); normalized != key && audit.redacted(normalized) {
+		return true
+	}
+	for _, pattern := range audit.Redact {
+		if pattern == key {
+			return true
+		}
+		if matched, _ := path.Match(pattern, key); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Must be called with the mutex held.
+func (audit *AuditLog) open() error {
+	file, err := os.OpenFile(audit.Filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	audit.file = file
+	audit.size = info.Size()
+	audit.opened = time.Now()
+	return nil
+}
+
+// Must be called with the mutex held.
+func (audit *AuditLog) rotate() error {
+	if audit.file != nil {
+		audit.file.Close()
+		audit.file = nil
+	}
+	rotated := audit.Filename + "." + time.Now().Format("20060102T150405.000")
+	for i := 1; fileExists(rotated) || fileExists(rotated+".gz"); i++ {
+		rotated = fmt.Sprintf("%s.%s-%d", audit.Filename, time.Now().Format("20060102T150405.000"), i)
+	}
+	err := os.Rename(audit.Filename, rotated)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		go audit.finishRotation(rotated)
+	}
+	return audit.open()
+}
+
+// Compresses the rotated file and removes old backups.
+func (audit *AuditLog) finishRotation(rotated string) {
+	audit.rotationMutex.Lock()
+	defer audit.rotationMutex.Unlock()
+	if audit.Compress && fileExists(rotated) {
+		if err := gzipFile(rotated); err != nil {
+			fmt.Println("Error compressing the audit log:", err)
+		}
+	}
+	if audit.MaxBackups <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(audit.Filename + ".*")
+	if err != nil {
+		return
+	}
+	kept := backups[:0]
+	for _, backup := range backups {
+		if !strings.HasSuffix(backup, ".tmp") {
+			kept = append(kept, backup)
+		}
+	}
+	sort.Strings(kept)
+	for len(kept) > audit.MaxBackups {
+		os.Remove(kept[0])
+		kept = kept[1:]
+	}
+}
+
+func fileExists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
+
+func gzipFile(filename string) error {
+	in, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(filename+".gz.tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(filename + ".gz.tmp")
+		return err
+	}
+	err = os.Rename(filename+".gz.tmp", filename+".gz")
+	if err != nil {
+		return err
+	}
+	return os.Remove(filename)
+}
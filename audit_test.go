@@ -0,0 +1,125 @@
+package shadowd
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns the ids of the events in a gzip compressed audit log.
+func readAuditIds(t *testing.T, filename string) []string {
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatalf("%s: %v", filename, err)
+	}
+	var ids []string
+	scanner := bufio.NewScanner(zr)
+	for scanner.Scan() {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("%s: %v", filename, err)
+		}
+		ids = append(ids, event.Id)
+	}
+	return ids
+}
+
+// Waits for the background compression and pruning of rotated files,
+// until there are count backups all ending with suffix.
+func waitForBackups(t *testing.T, pattern, suffix string, count int) []string {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		backups, _ := filepath.Glob(pattern)
+		done := len(backups) == count
+		for _, backup := range backups {
+			done = done && strings.HasSuffix(backup, suffix)
+		}
+		if done || time.Now().After(deadline) {
+			sort.Strings(backups)
+			return backups
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := NewAuditLog(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit.MaxSize = 1
+	audit.Compress = true
+	audit.MaxBackups = 2
+	for i := 0; i < 5; i++ {
+		event := testEvent(STATUS_ATTACK)
+		event.Id = strconv.Itoa(i)
+		audit.HandleEvent(event)
+		// rotated files are named after the time with a millisecond precision
+		time.Sleep(2 * time.Millisecond)
+	}
+	audit.Close()
+
+	backups := waitForBackups(t, filename+".*", ".gz", 2)
+	if len(backups) != 2 {
+		t.Fatalf("got backups %q, want 2", backups)
+	}
+	for i, backup := range backups {
+		if filepath.Ext(backup) != ".gz" {
+			t.Errorf("backup %s is not compressed", backup)
+			continue
+		}
+		if ids := readAuditIds(t, backup); len(ids) != 1 || ids[0] != strconv.Itoa(i+2) {
+			t.Errorf("%s: got events %q, want %d", backup, ids, i+2)
+		}
+	}
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event Event
+	if err := json.Unmarshal(contents, &event); err != nil || event.Id != "4" {
+		t.Errorf("current log %q, want the last event", contents)
+	}
+}
+
+func TestAuditLogRotateKeepsAllBackups(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := NewAuditLog(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		audit.HandleEvent(testEvent(STATUS_ATTACK))
+		if err := audit.Rotate(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	audit.Close()
+
+	backups := waitForBackups(t, filename+".*", "", 3)
+	if len(backups) != 3 {
+		t.Fatalf("got backups %q, want 3", backups)
+	}
+	for _, backup := range backups {
+		if filepath.Ext(backup) == ".gz" {
+			t.Errorf("backup %s compressed without Compress", backup)
+		}
+	}
+	if info, err := os.Stat(filename); err != nil || info.Size() != 0 {
+		t.Errorf("current log not empty after the rotation: %v", err)
+	}
+}
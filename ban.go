@@ -0,0 +1,294 @@
+package shadowd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default BanManager settings, used when the matching field is zero.
+const (
+	BAN_DEFAULT_THRESHOLD = 3
+	BAN_DEFAULT_WINDOW    = time.Minute
+	BAN_DEFAULT_DURATION  = 10 * time.Minute
+	BAN_DEFAULT_MAX       = 24 * time.Hour
+)
+
+// A locally banned client.
+// Count is the number of times the client was banned and is used to
+// escalate the duration of the next ban.
+type Ban struct {
+	IP     string    `json:"ip"`
+	Until  time.Time `json:"until"`
+	Count  int       `json:"count"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// Counts attack verdicts per client IP and bans clients that reach Threshold
+// attacks within Window. The first ban lasts Duration and every following
+// ban of the same client doubles it up to MaxDuration. A client that was
+// not banned for MaxDuration starts over.
+// When Filename is set the bans are persisted to it as json.
+// The hits older than Window and the bans that expired more than
+// MaxDuration ago are forgotten, at most once per Window.
+type BanManager struct {
+	Threshold   int
+	Window      time.Duration
+	Duration    time.Duration
+	MaxDuration time.Duration
+	Filename    string
+
+	mutex sync.Mutex
+	hits  map[string][]time.Time
+	bans  map[string]*Ban
+	swept time.Time
+}
+
+// Returns a BanManager with the default settings.
+// If filename is not empty the bans stored in it are loaded.
+func NewBanManager(filename string) (*BanManager, error) {
+	bm := &BanManager{Filename: filename}
+	if filename == "" {
+		return bm, nil
+	}
+	contents, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return bm, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var bans []Ban
+	err = json.Unmarshal(contents, &bans)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	bm.bans = make(map[string]*Ban)
+	for i := range bans {
+		bm.bans[bans[i].IP] = &bans[i]
+	}
+	return bm, nil
+}
+
+// Returns true if the ip is currently banned.
+// A nil BanManager bans nobody.
+func (bm *BanManager) IsBanned(ip string) bool {
+	if bm == nil {
+		return false
+	}
+	bm.mutex.Lock()
+	defer bm.mutex.Unlock()
+	ban, ok := bm.bans[ip]
+	return ok && time.Now().Before(ban.Until)
+}
+
+// Records a verdict for the ip, returns true if it resulted in a new ban.
+// Only STATUS_ATTACK and STATUS_CRITICAL_ATTACK verdicts are counted.
+func (bm *BanManager) Record(ip string, verdict *Verdict) bool {
+	if bm == nil || !verdict.IsAttack() {
+		return false
+	}
+	now := time.Now()
+	bm.mutex.Lock()
+	defer bm.mutex.Unlock()
+
+	if ban, ok := bm.bans[ip]; ok && now.Before(ban.Until) {
+		return false
+	}
+	if bm.hits == nil {
+		bm.hits = make(map[string][]time.Time)
+	}
+	window := bm.window()
+	if now.Sub(bm.swept) >= window {
+		bm.sweep(now)
+	}
+	hits := bm.hits[ip][:0]
+	for _, t := range bm.hits[ip] {
+		if now.Sub(t) < window {
+			hits = append(hits, t)
+		}
+	}
+	hits = append(hits, now)
+	threshold := bm.Threshold
+	if threshold <= 0 {
+		threshold = BAN_DEFAULT_THRESHOLD
+	}
+	if len(hits) < threshold {
+		bm.hits[ip] = hits
+		return false
+	}
+	delete(bm.hits, ip)
+	bm.ban(ip, 0, fmt.Sprintf("%d attacks within %v", len(hits), window))
+	bm.save()
+	return true
+}
+
+// Bans the ip for the given duration, a zero duration uses the escalating
+// duration as if the ban was triggered by attacks. Besides IP addresses
+// the ban keys of JWT subjects, such as "sub:alice", are accepted.
+func (bm *BanManager) Add(ip string, duration time.Duration) error {
+	if net.ParseIP(ip) == nil && !(strings.HasPrefix(ip, JWT_BAN_PREFIX) && len(ip) > len(JWT_BAN_PREFIX)) {
+		return fmt.Errorf("invalid IP address %q", ip)
+	}
+	bm.mutex.Lock()
+	defer bm.mutex.Unlock()
+	bm.ban(ip, duration, "added by operator")
+	return bm.save()
+}
+
+// Lifts the ban of the ip and forgets its history.
+// Returns false if the ip was not known.
+func (bm *BanManager) Remove(ip string) (bool, error) {
+	bm.mutex.Lock()
+	defer bm.mutex.Unlock()
+	_, ok := bm.bans[ip]
+	delete(bm.bans, ip)
+	delete(bm.hits, ip)
+	if !ok {
+		return false, nil
+	}
+	return true, bm.save()
+}
+
+// Returns the currently active bans ordered by expiry.
+func (bm *BanManager) List() []Ban {
+	now := time.Now()
+	bm.mutex.Lock()
+	defer bm.mutex.Unlock()
+	list := make([]Ban, 0, len(bm.bans))
+	for _, ban := range bm.bans {
+		if now.Before(ban.Until) {
+			list = append(list, *ban)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Until.Before(list[j].Until) })
+	return list
+}
+
+// An operators interface to the ban list.
+// GET lists the active bans as json, POST with an "ip" and an optional
+// "duration" form value adds a ban and DELETE with an "ip" removes it.
+func (bm *BanManager) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	ip := req.FormValue("ip")
+	switch req.Method {
+	case "GET":
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(bm.List())
+	case "POST":
+		var duration time.Duration
+		if value := req.FormValue("duration"); value != "" {
+			var err error
+			duration, err = time.ParseDuration(value)
+			if err != nil {
+				http.Error(res, err.Error(), 400)
+				return
+			}
+		}
+		if err := bm.Add(ip, duration); err != nil {
+			http.Error(res, err.Error(), 400)
+			return
+		}
+		res.WriteHeader(204)
+	case "DELETE":
+		found, err := bm.Remove(ip)
+		if err != nil {
+			http.Error(res, err.Error(), 500)
+			return
+		}
+		if !found {
+			http.NotFound(res, req)
+			return
+		}
+		res.WriteHeader(204)
+	default:
+		http.Error(res, "Unsupported Method", 405)
+	}
+}
+
+func (bm *BanManager) window() time.Duration {
+	if bm.Window <= 0 {
+		return BAN_DEFAULT_WINDOW
+	}
+	return bm.Window
+}
+
+func (bm *BanManager) maxDuration() time.Duration {
+	if bm.MaxDuration <= 0 {
+		return BAN_DEFAULT_MAX
+	}
+	return bm.MaxDuration
+}
+
+// Removes the clients without a hit in the window and the bans that no
+// longer escalate the next one, must be called with the mutex held.
+func (bm *BanManager) sweep(now time.Time) {
+	bm.swept = now
+	window := bm.window()
+	for ip, hits := range bm.hits {
+		if len(hits) == 0 || now.Sub(hits[len(hits)-1]) >= window {
+			delete(bm.hits, ip)
+		}
+	}
+	maxDuration := bm.maxDuration()
+	for ip, ban := range bm.bans {
+		if now.Sub(ban.Until) > maxDuration {
+			delete(bm.bans, ip)
+		}
+	}
+}
+
+func (bm *BanManager) ban(ip string, duration time.Duration, reason string) {
+	now := time.Now()
+	maxDuration := bm.maxDuration()
+	if bm.bans == nil {
+		bm.bans = make(map[string]*Ban)
+	}
+	ban, ok := bm.bans[ip]
+	if !ok || now.Sub(ban.Until) > maxDuration {
+		ban = &Ban{IP: ip}
+		bm.bans[ip] = ban
+	}
+	ban.Count++
+	if duration <= 0 {
+		duration = bm.Duration
+		if duration <= 0 {
+			duration = BAN_DEFAULT_DURATION
+		}
+		for i := 1; i < ban.Count && duration < maxDuration; i++ {
+			duration *= 2
+		}
+		if duration > maxDuration {
+			duration = maxDuration
+		}
+	}
+	ban.Until = now.Add(duration)
+	ban.Reason = reason
+}
+
+// Writes the bans to Filename, must be called with the mutex held.
+func (bm *BanManager) save() error {
+	if bm.Filename == "" {
+		return nil
+	}
+	bans := make([]Ban, 0, len(bm.bans))
+	for _, ban := range bm.bans {
+		bans = append(bans, *ban)
+	}
+	contents, err := json.MarshalIndent(bans, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpfile := bm.Filename + ".tmp"
+	err = os.WriteFile(tmpfile, contents, 0600)
+	if err != nil {
+		fmt.Println("Error saving the ban list:", err)
+		return err
+	}
+	return os.Rename(tmpfile, bm.Filename)
+}
@@ -0,0 +1,167 @@
+package shadowd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBanManagerRecord(t *testing.T) {
+	bm := &BanManager{Threshold: 3, Window: time.Minute}
+	attack := &Verdict{Status: STATUS_ATTACK}
+	for i := 0; i < 2; i++ {
+		if bm.Record("192.0.2.1", attack) {
+			t.Fatalf("banned after %d attacks", i+1)
+		}
+	}
+	if bm.Record("192.0.2.1", &Verdict{Status: STATUS_OK}) || bm.IsBanned("192.0.2.1") {
+		t.Fatalf("banned by a verdict that is not an attack")
+	}
+	if !bm.Record("192.0.2.1", attack) || !bm.IsBanned("192.0.2.1") {
+		t.Fatalf("not banned after 3 attacks")
+	}
+	if bm.IsBanned("192.0.2.2") {
+		t.Fatalf("unrelated client banned")
+	}
+}
+
+func TestBanManagerForgetsStaleEntries(t *testing.T) {
+	bm := &BanManager{Threshold: 2, Window: 20 * time.Millisecond, Duration: time.Millisecond, MaxDuration: time.Millisecond}
+	attack := &Verdict{Status: STATUS_ATTACK}
+	for i := 0; i < 1000; i++ {
+		bm.Record(fmt.Sprintf("2001:db8::%x", i), attack)
+	}
+	bm.Record("192.0.2.1", attack)
+	bm.Record("192.0.2.1", attack)
+	if len(bm.hits) != 1000 || len(bm.bans) != 1 {
+		t.Fatalf("got %d hits and %d bans, want 1000 and 1", len(bm.hits), len(bm.bans))
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	bm.Record("192.0.2.2", attack)
+	bm.mutex.Lock()
+	defer bm.mutex.Unlock()
+	if len(bm.hits) != 1 || len(bm.bans) != 0 {
+		t.Fatalf("got %d hits and %d bans after the window, want 1 and 0", len(bm.hits), len(bm.bans))
+	}
+}
+
+func TestBanManagerPersistence(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "bans.json")
+	bm, err := NewBanManager(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bm.Add("192.0.2.1", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := bm.Add("sub:alice", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filename + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+
+	loaded, err := NewBanManager(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.IsBanned("192.0.2.1") || !loaded.IsBanned("sub:alice") || loaded.IsBanned("192.0.2.2") {
+		t.Errorf("unexpected bans after loading %v", loaded.List())
+	}
+	if found, err := loaded.Remove("192.0.2.1"); !found || err != nil {
+		t.Fatalf("Remove returned %v %v", found, err)
+	}
+	loaded, _ = NewBanManager(filename)
+	if loaded.IsBanned("192.0.2.1") || !loaded.IsBanned("sub:alice") {
+		t.Errorf("removal not persisted %v", loaded.List())
+	}
+
+	os.WriteFile(filename, []byte("not json"), 0600)
+	if _, err := NewBanManager(filename); err == nil {
+		t.Errorf("loaded a corrupt ban list")
+	}
+	if bm, err := NewBanManager(filepath.Join(t.TempDir(), "missing.json")); err != nil || len(bm.List()) != 0 {
+		t.Errorf("missing file: got %v %v", bm, err)
+	}
+}
+
+func TestBanManagerServeHTTP(t *testing.T) {
+	bm := &BanManager{}
+	serve := func(method, target string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		res := httptest.NewRecorder()
+		bm.ServeHTTP(res, req)
+		return res
+	}
+	tests := []struct {
+		method string
+		form   url.Values
+		code   int
+	}{
+		{"POST", url.Values{"ip": {"192.0.2.1"}, "duration": {"1h"}}, 204},
+		{"POST", url.Values{"ip": {"sub:alice"}}, 204},
+		{"POST", url.Values{"ip": {"not-an-ip"}}, 400},
+		{"POST", url.Values{"ip": {"sub:"}}, 400},
+		{"POST", url.Values{"ip": {"192.0.2.2"}, "duration": {"soon"}}, 400},
+		{"DELETE", url.Values{"ip": {"192.0.2.9"}}, 404},
+		{"PUT", nil, 405},
+	}
+	for _, test := range tests {
+		if res := serve(test.method, "/bans", test.form); res.Code != test.code {
+			t.Errorf("%s %v: got %d, want %d", test.method, test.form, res.Code, test.code)
+		}
+	}
+
+	res := serve("GET", "/bans", nil)
+	var bans []Ban
+	if err := json.Unmarshal(res.Body.Bytes(), &bans); err != nil {
+		t.Fatal(err)
+	}
+	if len(bans) != 2 || bans[0].IP != "sub:alice" || bans[1].IP != "192.0.2.1" {
+		t.Errorf("got bans %+v", bans)
+	}
+	if res := serve("DELETE", "/bans?ip=192.0.2.1", nil); res.Code != 204 || bm.IsBanned("192.0.2.1") {
+		t.Errorf("DELETE: got %d", res.Code)
+	}
+}
+
+func TestBanKeyRecordsTheClientIP(t *testing.T) {
+	serverconn := &ShadowdConn{
+		ProfileId:  "1",
+		ProfileKey: "k",
+		Transport:  &recordingTransport{reply: `{"status":5,"threats":["GET|q"]}`},
+		Bans:       &BanManager{Threshold: 3},
+		BanKey: func(req *http.Request) string {
+			if token := req.Header.Get("X-Token"); token != "" {
+				return JWT_BAN_PREFIX + token
+			}
+			return ""
+		},
+	}
+	for _, token := range []string{"a", "b", ""} {
+		req := httptest.NewRequest("GET", "/?q=attack", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("X-Token", token)
+		if _, err := serverconn.Check(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-Token", "c")
+	if verdict, ok := serverconn.CheckLocal(req); !ok || verdict.Source != SOURCE_BAN_LIST {
+		t.Errorf("client rotating tokens not banned")
+	}
+	if serverconn.Bans.IsBanned("sub:a") {
+		t.Errorf("subject banned after a single attack")
+	}
+}
@@ -0,0 +1,83 @@
+package shadowd
+
+import (
+	"context"
+	"net/http"
+)
+
+// Caller strategies, deciding what is sent to shadowd as the caller.
+// Shadowd learns its whitelist and blacklist rules per caller.
+const (
+	CALLER_PATH      = 0
+	CALLER_ROUTE     = 1
+	CALLER_HOST_PATH = 2
+	CALLER_SCRIPT    = 3
+	CALLER_FUNC      = 4
+)
+
+const routeNameContextKey contextKey = 2
+
+// Returns a shallow copy of req carrying the route name, used by the
+// CALLER_ROUTE strategy. Routers or handlers wrapping the Middleware can
+// set it for every route.
+func WithRouteName(req *http.Request, name string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), routeNameContextKey, name))
+}
+
+// Returns the route name stored by WithRouteName.
+func RouteNameFromContext(ctx context.Context) (string, bool) {
+	name, ok := ctx.Value(routeNameContextKey).(string)
+	return name, ok
+}
+
+// Returns the caller of the request according to the CallerStrategy.
+// When Routes matches the request its template replaces the path, so all
+// of the requests of a route share one caller. CALLER_ROUTE falls back to
+// the template or path for requests without a route name and CALLER_FUNC
+// uses CallerFunc. The operation name of GraphQL requests takes precedence.
+func (serverconn *ShadowdConn) Caller(req *http.Request) string {
+	if serverconn.GraphQL != nil {
+		if name := serverconn.GraphQL.OperationName(req); name != "" {
+			return name
+		}
+	}
+	strategy := serverconn.CallerStrategy
+	if strategy == CALLER_PATH && serverconn.PHPCompat {
+		strategy = CALLER_SCRIPT
+	}
+	urlpath := req.URL.Path
+	if template, ok := serverconn.routeTemplate(req); ok {
+		urlpath = template
+	}
+	switch strategy {
+	case CALLER_ROUTE:
+		if name, ok := RouteNameFromContext(req.Context()); ok && name != "" {
+			return name
+		}
+	case CALLER_HOST_PATH:
+		return req.Host + urlpath
+	case CALLER_SCRIPT:
+		return serverconn.phpScriptFilename(req)
+	case CALLER_FUNC:
+		if serverconn.CallerFunc != nil {
+			return serverconn.CallerFunc(req)
+		}
+	}
+	return urlpath
+}
+
+// Returns the resource of the request, the request URI in PHPCompat mode
+// like the PHP connector and the path otherwise.
+func (serverconn *ShadowdConn) Resource(req *http.Request) string {
+	if serverconn.PHPCompat {
+		return requestURI(req)
+	}
+	return req.URL.Path
+}
+
+func requestURI(req *http.Request) string {
+	if req.RequestURI != "" {
+		return req.RequestURI
+	}
+	return req.URL.RequestURI()
+}
@@ -0,0 +1,21 @@
+package shadowd
+
+import (
+	"context"
+)
+
+type contextKey int
+
+const verdictContextKey contextKey = 0
+
+// Returns a copy of ctx carrying the verdict.
+func ContextWithVerdict(ctx context.Context, verdict *Verdict) context.Context {
+	return context.WithValue(ctx, verdictContextKey, verdict)
+}
+
+// Returns the verdict stored in ctx by the Middleware.
+// The second value is false for requests that did not pass the Middleware.
+func VerdictFromContext(ctx context.Context) (*Verdict, bool) {
+	verdict, ok := ctx.Value(verdictContextKey).(*Verdict)
+	return verdict, ok
+}
@@ -0,0 +1,78 @@
+package shadowd
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Returned by the RoundTripper when shadowd identified an outgoing request
+// as an attack, such as a request forged to reach an internal service.
+type EgressError struct {
+	URL     string
+	Verdict *Verdict
+}
+
+func (err *EgressError) Error() string {
+	return fmt.Sprintf("shadowd: request to %s refused with status %d, threats: %v", err.URL, err.Verdict.Status, err.Verdict.Threats)
+}
+
+// An http.RoundTripper analysing outgoing requests before they are sent,
+// against SSRF and injections into the called services:
+//
+//	client := &http.Client{Transport: &shadowd.RoundTripper{Conn: &egressConn}}
+//
+// Conn should use a profile dedicated to outgoing requests. The payload is
+// built like the one of an incoming request, so the query, headers, the
+// body when Conn.ReadBody is set, and the destination as SERVER|HTTP_HOST
+// and SERVER|HTTP_PORT are inputs. ClientIP, when set, returns the client
+// the request is made for, such as the one of the incoming request found
+// in its context.
+//
+// Requests with an attack verdict are refused with an *EgressError,
+// requests with any other verdict than STATUS_OK with a *StatusError and
+// requests that could not be checked with the error of the check.
+type RoundTripper struct {
+	// Sends the requests, nil uses http.DefaultTransport.
+	Transport http.RoundTripper
+	Conn      *ShadowdConn
+	ClientIP  func(req *http.Request) string
+}
+
+func (rt *RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper must not modify the request, while reading the body
+	// replaces it.
+	outreq := req.Clone(req.Context())
+	if outreq.Host == "" {
+		outreq.Host = outreq.URL.Host
+	}
+	if rt.ClientIP != nil {
+		outreq.RemoteAddr = rt.ClientIP(req)
+	}
+
+	verdict, err := rt.Conn.Check(outreq)
+	if req.Body != nil && outreq.Body != req.Body {
+		// Reading the body replaced it with a copy, the original must
+		// still be closed.
+		req.Body.Close()
+	}
+	if err == nil && verdict.IsAttack() {
+		err = &EgressError{URL: req.URL.String(), Verdict: verdict}
+	} else if err == nil && verdict.Status != STATUS_OK {
+		err = &StatusError{Verdict: verdict}
+	}
+	if err != nil {
+		if !rt.Conn.Observe {
+			if outreq.Body != nil {
+				outreq.Body.Close()
+			}
+			return nil, err
+		}
+		fmt.Println("Request to", req.URL.Host, "not refused in observe mode:", err)
+	}
+
+	transport := rt.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return transport.RoundTrip(outreq)
+}
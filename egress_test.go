@@ -0,0 +1,96 @@
+package shadowd
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type closeTrackingBody struct {
+	io.Reader
+	closed bool
+}
+
+func (body *closeTrackingBody) Close() error {
+	body.closed = true
+	return nil
+}
+
+type fakeRoundTripper struct {
+	bodies []string
+}
+
+func (rt *fakeRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	body := ""
+	if req.Body != nil {
+		data, _ := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		body = string(data)
+	}
+	rt.bodies = append(rt.bodies, body)
+	return &http.Response{StatusCode: 200, Body: http.NoBody, Request: req}, nil
+}
+
+func TestRoundTripper(t *testing.T) {
+	const attack = `{"status":5,"threats":["DATA|raw"]}`
+	tests := []struct {
+		body     string
+		reply    string
+		readBody bool
+		observe  bool
+		err      error // of the type expected when not sent
+	}{
+		{"q=ok", `{"status":1}`, true, false, nil},
+		{"q=ok", `{"status":1}`, false, false, nil},
+		{"url=http://169.254.169.254/", attack, true, false, &EgressError{}},
+		{"url=http://169.254.169.254/", attack, true, true, nil},
+		{"q=ok", `{"status":2}`, true, false, &StatusError{}},
+		{"q=ok", `{"status":3}`, true, false, &StatusError{}},
+		{"q=ok", `{"status":4}`, true, false, &StatusError{}},
+		{"q=ok", `{"status":3}`, true, true, nil},
+	}
+	for _, test := range tests {
+		transport := &recordingTransport{reply: test.reply}
+		next := &fakeRoundTripper{}
+		rt := &RoundTripper{
+			Transport: next,
+			Conn:      &ShadowdConn{ProfileId: "1", ProfileKey: "k", ReadBody: test.readBody, Transport: transport, Observe: test.observe},
+		}
+		body := &closeTrackingBody{Reader: strings.NewReader(test.body)}
+		req, _ := http.NewRequest("POST", "http://api.example.com/fetch", body)
+		req.Header.Set("Content-Type", "text/plain")
+
+		res, err := rt.RoundTrip(req)
+		name := test.body + " " + test.reply
+		var egressErr *EgressError
+		var statusErr *StatusError
+		switch test.err.(type) {
+		case nil:
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+			} else if len(next.bodies) != 1 || next.bodies[0] != test.body {
+				t.Errorf("%s: sent bodies %q", name, next.bodies)
+			}
+		case *EgressError:
+			if !errors.As(err, &egressErr) || len(next.bodies) != 0 {
+				t.Errorf("%s: got %v and sent %q, want an EgressError", name, err, next.bodies)
+			}
+		case *StatusError:
+			if !errors.As(err, &statusErr) || len(next.bodies) != 0 {
+				t.Errorf("%s: got %v and sent %q, want a StatusError", name, err, next.bodies)
+			}
+		}
+		if res != nil {
+			res.Body.Close()
+		}
+		if !body.closed {
+			t.Errorf("%s: request body not closed", name)
+		}
+		if test.readBody && len(transport.sent) == 1 && !strings.Contains(string(transport.sent[0].Data), test.body) {
+			t.Errorf("%s: body not analysed: %s", name, transport.sent[0].Data)
+		}
+	}
+}
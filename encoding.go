@@ -0,0 +1,189 @@
+package shadowd
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// How input keys and values that are not valid UTF-8 are sent to shadowd.
+//
+// ENCODING_ESCAPE, the default, writes each invalid byte as "\xHH" and
+// doubles the backslashes of every value, so the original bytes can be
+// recovered and no valid value reads like an escaped one. Keys are only
+// escaped when they are not valid UTF-8. ENCODING_LATIN1 reads invalid bytes as ISO-8859-1 characters.
+// ENCODING_REPLACE keeps the json behaviour of replacing them with U+FFFD,
+// which is lossy.
+const (
+	ENCODING_ESCAPE  = 0
+	ENCODING_LATIN1  = 1
+	ENCODING_REPLACE = 2
+)
+
+// Bytes 0x80-0x9f of Windows-1252, the zero entries are undefined.
+var windows1252 = [32]rune{
+	0x20ac, 0, 0x201a, 0x0192, 0x201e, 0x2026, 0x2020, 0x2021,
+	0x02c6, 0x2030, 0x0160, 0x2039, 0x0152, 0, 0x017d, 0,
+	0, 0x2018, 0x2019, 0x201c, 0x201d, 0x2022, 0x2013, 0x2014,
+	0x02dc, 0x2122, 0x0161, 0x203a, 0x0153, 0, 0x017e, 0x0178,
+}
+
+// Converts the body inputs from charset, the one of the request
+// Content-Type, to UTF-8, then encodes every key and value that is
+// still not valid UTF-8 according to BinaryEncoding. Sets payload.Lossy
+// when a conversion could not keep the original bytes.
+func (serverconn *ShadowdConn) encodeInputs(charset string, payload *Payload) {
+	encoded := make(map[string]string, len(payload.Input))
+	for k, v := range payload.Input {
+		if charset != "" && serverconn.isBodyInput(k) {
+			converted, lossy, err := TranscodeToUTF8([]byte(v), charset)
+			if err == nil {
+				v = converted
+				payload.Lossy = payload.Lossy || lossy
+			} else if serverconn.Debug {
+				fmt.Println("Not transcoding the body:", err)
+			}
+		}
+		k = serverconn.encodeString(k, payload)
+		if serverconn.BinaryEncoding == ENCODING_ESCAPE {
+			v = EscapeBinary(v)
+		} else {
+			v = serverconn.encodeString(v, payload)
+		}
+		encoded[k] = v
+	}
+	payload.Input = encoded
+}
+
+// Returns the lower case charset of the request Content-Type.
+func requestCharset(req *http.Request) string {
+	_, params, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return strings.ToLower(params["charset"])
+}
+
+// Returns true for the inputs read from the body. Only the PHP extractors
+// send the form fields as POST and FILES inputs, otherwise those are query
+// arguments of POST requests.
+func (serverconn *ShadowdConn) isBodyInput(key string) bool {
+	if strings.HasPrefix(key, "DATA|") {
+		return true
+	}
+	return serverconn.PHPCompat && (strings.HasPrefix(key, "POST|") || strings.HasPrefix(key, "FILES|"))
+}
+
+func (serverconn *ShadowdConn) encodeString(s string, payload *Payload) string {
+	if utf8.ValidString(s) {
+		return s
+	}
+	switch serverconn.BinaryEncoding {
+	case ENCODING_LATIN1:
+		return decodeLatin1([]byte(s))
+	case ENCODING_REPLACE:
+		payload.Lossy = true
+		return strings.ToValidUTF8(s, "\uFFFD")
+	}
+	return EscapeBinary(s)
+}
+
+// Returns s with its invalid UTF-8 bytes written as "\xHH" and its
+// backslashes doubled.
+func EscapeBinary(s string) string {
+	if utf8.ValidString(s) && strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			fmt.Fprintf(&b, "\\x%02x", s[i])
+		case r == '\\':
+			b.WriteString("\\\\")
+		default:
+			b.WriteString(s[i : i+size])
+		}
+		i += size
+	}
+	return b.String()
+}
+
+// Converts data from one of the common charsets to UTF-8.
+// Supported are UTF-8, US-ASCII, ISO-8859-1, Windows-1252 and UTF-16 (with
+// a byte order mark, big endian without), UTF-16LE and UTF-16BE.
+// The second value is true when some bytes could not be converted and
+// were replaced with U+FFFD.
+func TranscodeToUTF8(data []byte, charset string) (string, bool, error) {
+	switch strings.ToLower(charset) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return string(data), false, nil
+	case "iso-8859-1", "iso8859-1", "latin1", "l1":
+		return decodeLatin1(data), false, nil
+	case "windows-1252", "cp1252", "x-cp1252":
+		return decodeWindows1252(data)
+	case "utf-16":
+		if len(data) >= 2 && data[0] == 0xff && data[1] == 0xfe {
+			return decodeUTF16(data[2:], false)
+		}
+		if len(data) >= 2 && data[0] == 0xfe && data[1] == 0xff {
+			data = data[2:]
+		}
+		return decodeUTF16(data, true)
+	case "utf-16le":
+		return decodeUTF16(data, false)
+	case "utf-16be":
+		return decodeUTF16(data, true)
+	}
+	return "", false, fmt.Errorf("unsupported charset %q", charset)
+}
+
+func decodeLatin1(data []byte) string {
+	runes := make([]rune, len(data))
+	for i, c := range data {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+func decodeWindows1252(data []byte) (string, bool, error) {
+	lossy := false
+	runes := make([]rune, len(data))
+	for i, c := range data {
+		runes[i] = rune(c)
+		if c >= 0x80 && c <= 0x9f {
+			runes[i] = windows1252[c-0x80]
+			if runes[i] == 0 {
+				runes[i] = utf8.RuneError
+				lossy = true
+			}
+		}
+	}
+	return string(runes), lossy, nil
+}
+
+func decodeUTF16(data []byte, bigEndian bool) (string, bool, error) {
+	lossy := len(data)%2 != 0
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		if bigEndian {
+			units[i] = uint16(data[2*i])<<8 | uint16(data[2*i+1])
+		} else {
+			units[i] = uint16(data[2*i+1])<<8 | uint16(data[2*i])
+		}
+	}
+	for i := 0; i < len(units) && !lossy; i++ {
+		switch {
+		case utf16.IsSurrogate(rune(units[i])) && units[i] < 0xdc00:
+			if i+1 >= len(units) || units[i+1] < 0xdc00 || units[i+1] > 0xdfff {
+				lossy = true
+			}
+			i++
+		case utf16.IsSurrogate(rune(units[i])):
+			lossy = true
+		}
+	}
+	runes := utf16.Decode(units)
+	return string(runes), lossy, nil
+}
@@ -0,0 +1,92 @@
+package shadowd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTranscodeToUTF8(t *testing.T) {
+	tests := []struct {
+		data    string
+		charset string
+		want    string
+		lossy   bool
+	}{
+		{"caf\xc3\xa9", "UTF-8", "caf\xc3\xa9", false},
+		{"caf\xe9", "iso-8859-1", "café", false},
+		{"caf\xe9", "Latin1", "café", false},
+		{"\x80 \x93x\x94", "windows-1252", "€ “x”", false},
+		{"a\x81b", "cp1252", "a�b", true},
+		{"\xff\xfeA\x00\xe9\x00", "utf-16", "Aé", false},
+		{"\xfe\xff\x00A\x00\xe9", "utf-16", "Aé", false},
+		{"\x00A\x00\xe9", "utf-16", "Aé", false},
+		{"A\x00\x3d\xd8\x00\xde", "utf-16le", "A😀", false},
+		{"\x00A\xd8\x3d\xde\x00", "UTF-16BE", "A😀", false},
+		{"A\x00B", "utf-16le", "A", true},
+		{"\x3d\xd8A\x00", "utf-16le", "�A", true},
+		{"\x00\xdcA\x00", "utf-16le", "�A", true},
+	}
+	for _, test := range tests {
+		got, lossy, err := TranscodeToUTF8([]byte(test.data), test.charset)
+		if err != nil || got != test.want || lossy != test.lossy {
+			t.Errorf("TranscodeToUTF8(%q, %s) = %q, %v, %v, want %q, %v", test.data, test.charset, got, lossy, err, test.want, test.lossy)
+		}
+	}
+	if _, _, err := TranscodeToUTF8([]byte("x"), "koi8-r"); err == nil {
+		t.Errorf("expected an error for an unsupported charset")
+	}
+}
+
+func TestEscapeBinary(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"plain", "plain"},
+		{"caf\xc3\xa9", "caf\xc3\xa9"},
+		{"\xc0'", `\xc0'`},
+		{`\xc0'`, `\\xc0'`},
+		{"a\\b\xff", `a\\b\xff`},
+	}
+	for _, test := range tests {
+		if got := EscapeBinary(test.value); got != test.want {
+			t.Errorf("EscapeBinary(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestEncodeInputs(t *testing.T) {
+	inputs := map[string]string{
+		"GET|binary":  "\xc0'",
+		"GET|literal": `\xc0'`,
+		"GET|a\\|b":   "plain",
+		"GET|k\xff":   "v",
+		"DATA|raw":    "caf\xe9",
+	}
+	tests := []struct {
+		encoding int
+		want     map[string]string
+		lossy    bool
+	}{
+		{ENCODING_ESCAPE, map[string]string{
+			"GET|binary": `\xc0'`, "GET|literal": `\\xc0'`, "GET|a\\|b": "plain", `GET|k\xff`: "v", "DATA|raw": "café",
+		}, false},
+		{ENCODING_LATIN1, map[string]string{
+			"GET|binary": "À'", "GET|literal": `\xc0'`, "GET|a\\|b": "plain", "GET|kÿ": "v", "DATA|raw": "café",
+		}, false},
+		{ENCODING_REPLACE, map[string]string{
+			"GET|binary": "\uFFFD'", "GET|literal": `\xc0'`, "GET|a\\|b": "plain", "GET|k\uFFFD": "v", "DATA|raw": "café",
+		}, true},
+	}
+	for _, test := range tests {
+		serverconn := &ShadowdConn{BinaryEncoding: test.encoding}
+		payload := &Payload{Input: make(map[string]string)}
+		for k, v := range inputs {
+			payload.Input[k] = v
+		}
+		serverconn.encodeInputs("iso-8859-1", payload)
+		if !reflect.DeepEqual(payload.Input, test.want) || payload.Lossy != test.lossy {
+			t.Errorf("encoding %d: got %q lossy %v, want %q lossy %v", test.encoding, payload.Input, payload.Lossy, test.want, test.lossy)
+		}
+	}
+}
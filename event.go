@@ -0,0 +1,53 @@
+package shadowd
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// A record of a single check, passed to every Sink of the connector.
+// Id is a random incident ID identifying the check.
+type Event struct {
+	Time     time.Time         `json:"time"`
+	Id       string            `json:"id"`
+	ClientIP string            `json:"client_ip"`
+	Method   string            `json:"method"`
+	Host     string            `json:"host"`
+	URL      string            `json:"url"`
+	Caller   string            `json:"caller"`
+	Resource string            `json:"resource"`
+	Inputs   map[string]string `json:"inputs,omitempty"`
+	Status   int               `json:"status"`
+	Threats  []string          `json:"threats,omitempty"`
+	Latency  time.Duration     `json:"latency_ns"`
+	Lossy    bool              `json:"lossy,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+// A destination for check events such as the AuditLog.
+// HandleEvent is called synchronously after each check and must not modify
+// the event, sinks that do slow work should queue it.
+type Sink interface {
+	HandleEvent(event *Event)
+}
+
+func newEvent(req *http.Request) *Event {
+	return &Event{
+		Time:     time.Now(),
+		Id:       newRequestId(),
+		ClientIP: ClientIP(req),
+		Method:   req.Method,
+		Host:     req.Host,
+		URL:      req.URL.RequestURI(),
+	}
+}
+
+func (serverconn *ShadowdConn) emit(event *Event) {
+	for _, sink := range serverconn.Sinks {
+		sink.HandleEvent(event)
+	}
+	if serverconn.Debug && len(serverconn.Sinks) > 0 {
+		fmt.Println("Event", event.Id, "sent to", len(serverconn.Sinks), "sinks")
+	}
+}
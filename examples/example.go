@@ -1,3 +1,5 @@
+//go:build ignore
+
 // An emulation of a request analysis process
 //
 package main
@@ -1,10 +1,11 @@
+//go:build ignore
+
 // An example http file server that is protected against floods attacks
 //
 package main
 
 import (
 	"encoding/base64"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/elico/go-metalink-parser"
@@ -94,6 +95,19 @@ func httpHandlerToHandlerMetalink(next http.Handler) http.Handler {
 	})
 }
 
+// Matches the request to the template and variables of the mux route
+func muxRoute(req *http.Request) (string, map[string]string, bool) {
+	route := mux.CurrentRoute(req)
+	if route == nil {
+		return "", nil, false
+	}
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return "", nil, false
+	}
+	return template, mux.Vars(req), true
+}
+
 func unsupportedMethod(w http.ResponseWriter, r *http.Request) {
 	cacheResponseFor(w, r, 600)
 	http.Error(w, "Unsupported Method", 405)
@@ -113,56 +127,6 @@ func dontCacheResponse(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Expires", cacheUntil)
 }
 
-func httpHandlerToHandlerShadowd(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
-		shodowdres, err := shadowServer.SendToShadowd(req)
-		newmap := make(map[string]interface{})
-		err = json.Unmarshal([]byte(shodowdres), &newmap)
-		if err != nil {
-			panic(err)
-		}
-		switch int(newmap["status"].(float64)) {
-		case shadowd.STATUS_OK:
-			fmt.Println("Request reported, OK")
-		case shadowd.STATUS_BAD_REQUEST:
-			res.Header().Set("Content-Type", "text/html")
-			res.WriteHeader(400)
-			res.Write([]byte(internalerrorpage))
-			return
-		case shadowd.STATUS_BAD_SIGNATURE:
-			res.Header().Set("Content-Type", "text/html")
-			res.WriteHeader(500)
-			res.Write([]byte(internalerrorpage))
-			return
-		case shadowd.STATUS_BAD_JSON:
-			res.Header().Set("Content-Type", "text/html")
-			res.WriteHeader(500)
-			res.Write([]byte(internalerrorpage))
-			return
-		case shadowd.STATUS_ATTACK:
-			fmt.Println("This is an attack, needs to take action!")
-			res.Header().Set("Content-Type", "text/html")
-			res.WriteHeader(500)
-			res.Write([]byte(internalerrorpage))
-			return
-		case shadowd.STATUS_CRITICAL_ATTACK:
-			fmt.Println("This is a critical attack, needs to take action!")
-			res.Header().Set("Content-Type", "text/html")
-			res.WriteHeader(500)
-			res.Write([]byte(internalerrorpage))
-			return
-		default:
-			fmt.Println("Something werid happen, response code => ", int(newmap["status"].(float64)))
-			res.Header().Set("Content-Type", "text/html")
-			res.WriteHeader(500)
-			res.Write([]byte(internalerrorpage))
-			return
-		}
-		next.ServeHTTP(res, req)
-		return
-	})
-}
-
 func init() {
 	debug = flag.Bool("debug", false, "Use \"1\" to enable")
 	http_port = flag.String("http_port", "127.0.0.1:8080", "ip:port or plain \":port\" to listen on all IPs")
@@ -202,11 +166,15 @@ func main() {
 		Logfile:    "",
 		Debug:      *shadowd_debug,
 		ProfileKey: *shadowd_profilekey,
+		BlockPage:  internalerrorpage,
+		Metrics:    shadowd.NewMetrics(),
 	}
+	shadowServer.Routes = muxRoute
 	router := mux.NewRouter().StrictSlash(true)
 
 	//router.PathPrefixWithName("/fs/").Handler(httpHandlerToHandler(http.StripPrefix("/fs/", http.FileServer(http.Dir(*fs)))))
-	router.PathPrefixWithName("/fs/").Handler(httpHandlerToHandlerShadowd(http.StripPrefix("/fs/", http.FileServer(http.Dir(*fs)))))
+	router.Handle("/metrics", shadowServer.Metrics)
+	router.PathPrefixWithName("/fs/").Handler(shadowServer.Middleware(http.StripPrefix("/fs/", http.FileServer(http.Dir(*fs)))))
 
 	err := http.ListenAndServe(*http_port, router)
 
@@ -0,0 +1,79 @@
+//go:build ignore
+
+// An example gRPC reverse proxy that checks the calls against shadowd
+//
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/elico/go-shadowd"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+)
+
+var shadowd_addr *string
+var shadowd_profileid *string
+var shadowd_profilekey *string
+var shadowd_debug *bool
+var shadowd_observe *bool
+
+var shadowServer shadowd.ShadowdConn
+
+// Names the fields of the known request messages, the others are sent with
+// their field numbers.
+var registry = &shadowd.ProtoRegistry{
+	Methods: map[string]string{
+		"/helloworld.Greeter/SayHello": "helloworld.HelloRequest",
+	},
+	Messages: map[string]map[int]shadowd.ProtoField{
+		"helloworld.HelloRequest": {
+			1: {Name: "name", Kind: shadowd.PROTO_STRING},
+		},
+	},
+}
+
+func main() {
+	port := flag.String("port", ":50051", "ip:port or plain \":port\" to listen on all IPs")
+	upstream := flag.String("upstream", "http://127.0.0.1:50052", "url of the gRPC server, spoken to over cleartext HTTP/2")
+
+	shadowd_addr = flag.String("shadowd_addr", "127.0.0.1:9115", "ip:port of shadowd server")
+	shadowd_profileid = flag.String("shadowd_profileid", "1", "Must be a number")
+	shadowd_profilekey = flag.String("shadowd_profilekey", "102030", "It's a key to hash the data")
+	shadowd_debug = flag.Bool("shadowd_debug", false, "Use \"1\" to enable")
+	shadowd_observe = flag.Bool("shadowd_observe", false, "Only log rejected calls instead of ending them")
+
+	flag.Parse()
+	shadowServer = shadowd.ShadowdConn{ServerAddr: *shadowd_addr,
+		ProfileId:  *shadowd_profileid,
+		Debug:      *shadowd_debug,
+		ProfileKey: *shadowd_profilekey,
+		Observe:    *shadowd_observe,
+		Metrics:    shadowd.NewMetrics(),
+	}
+
+	target, err := url.Parse(*upstream)
+	if err != nil {
+		panic(err)
+	}
+	h2c := new(http.Protocols)
+	h2c.SetUnencryptedHTTP2(true)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = &http.Transport{Protocols: h2c}
+
+	inspector := &shadowd.GRPCInspector{
+		Conn:      &shadowServer,
+		Extractor: &shadowd.GRPCExtractor{Registry: registry},
+	}
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	server := &http.Server{Addr: *port, Handler: inspector.Handler(proxy), Protocols: protocols}
+
+	fmt.Printf("server will run on : %s\n", *port)
+	fmt.Printf("redirecting to :%s\n", *upstream)
+	if err := server.ListenAndServe(); err != nil {
+		panic(err)
+	}
+}
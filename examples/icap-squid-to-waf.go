@@ -1,3 +1,5 @@
+//go:build ignore
+
 // This tool is very helpful for GET requests logging and also helps
 // to understand and analyze better mis-caching issues.
 // To use with squid add the next to the squid.conf
@@ -22,7 +24,8 @@ import (
 	"os"
 	"strconv"
 	"strings"
-	"encoding/json"
+	"syscall"
+	"os/signal"
 )
 
 var ISTag = "\"Shadower\""
@@ -38,6 +41,11 @@ var shadowd_profileid *string
 var shadowd_profilekey *string
 var shadowd_debug *bool
 var shadowd_rawdata *bool
+var shadowd_acl *string
+var metrics_addr *string
+var syslog_network *string
+var syslog_addr *string
+var syslog_format *string
 var shadowServer shadowd.ShadowdConn
 
 const internalerrorpage = `<!DOCTYPE html>
@@ -159,18 +167,28 @@ func toShadowD(w icap.ResponseWriter, req *icap.Request) {
 			}
 		}
 
+		verdict, decided := shadowServer.CheckLocal(req.Request)
+		if !decided && !shadowServer.ShouldAnalyze(req.Request) {
+			if *debug || local_debug {
+				fmt.Println("This request was skipped by the analysis policy")
+			}
+			w.WriteHeader(204, nil, false)
+			return
+		}
+
 		// Send the request to ShadowD
 		// If an attack(5,6) was declared then send a custom 500 page
 		// If OK then send a 204 back
 		var resStatus = 1
-		shodowdres, err := shadowServer.SendToShadowd(req.Request)
-		newmap := make(map[string]interface{})
-		err = json.Unmarshal([]byte(shodowdres), &newmap)
-		if err != nil {
-			panic(err)
+		if !decided {
+			var err error
+			verdict, err = shadowServer.Check(req.Request)
+			if err != nil {
+				panic(err)
+			}
 		}
 		
-		switch int(newmap["status"].(float64)) {
+		switch verdict.Status {
 		case shadowd.STATUS_OK:
 			if *debug || local_debug {
 				fmt.Println("Request reported, OK")
@@ -268,6 +286,16 @@ func defaultIcap(w icap.ResponseWriter, req *icap.Request) {
 	}
 }
 
+func reloadOnHangup(acl *shadowd.AccessList) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		if err := acl.Reload(); err != nil {
+			fmt.Fprintln(os.Stderr, "Error reloading the access list:", err)
+		}
+	}
+}
+
 func init() {
 	fmt.Fprintln(os.Stderr, "Shadower WAF connector ICAP service")
 
@@ -278,6 +306,11 @@ func init() {
 	shadowd_profileid = flag.String("shadowd_profileid", "1", "Must be a number")
 	shadowd_profilekey = flag.String("shadowd_profilekey", "102030", "It's a key to hash the data")
 	shadowd_debug = flag.Bool("shadowd_debug", false, "Use \"1\" to enable")
+	metrics_addr = flag.String("metrics_addr", "", "ip:port to serve the connector metrics on, empty disables it")
+	syslog_network = flag.String("syslog_network", "udp", "Network of the syslog server, udp, tcp or unixgram")
+	syslog_addr = flag.String("syslog_addr", "", "Address of the syslog server attacks are reported to, empty disables it")
+	syslog_format = flag.String("syslog_format", "cef", "Format of the syslog attack reports, cef or leef")
+	shadowd_acl = flag.String("shadowd_acl", "", "Allow/deny list file evaluated before shadowd, reloaded on SIGHUP")
 	//shadowd_rawdata = flag.Bool("shadowd_rawdata", false, "Log request raw data Use \"1\" to enable")
 
 	flag.Parse()
@@ -301,6 +334,24 @@ func main() {
 		Logfile:    "",
 		Debug:      *shadowd_debug,
 		ProfileKey: *shadowd_profilekey,
+		Metrics:    shadowd.NewMetrics(),
+	}
+	if *syslog_addr != "" {
+		syslog, err := shadowd.NewSyslogSink(*syslog_network, *syslog_addr, *syslog_format)
+		if err != nil {
+			panic(err)
+		}
+		shadowServer.Sinks = append(shadowServer.Sinks, syslog)
+	}
+	if *metrics_addr != "" {
+		go http.ListenAndServe(*metrics_addr, shadowServer.Metrics)
+	}
+	if *shadowd_acl != "" {
+		shadowServer.AccessList, err = shadowd.LoadAccessList(*shadowd_acl)
+		if err != nil {
+			panic(err)
+		}
+		go reloadOnHangup(shadowServer.AccessList)
 	}
 	
 	icap.HandleFunc("/shadower/", toShadowD)
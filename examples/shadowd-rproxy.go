@@ -1,15 +1,21 @@
+//go:build ignore
+
 // Based on some of the from at the url: http://www.darul.io/post/2015-07-22_go-lang-simple-reverse-proxy
 //
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/elico/go-shadowd"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 var shadowd_addr *string
@@ -17,6 +23,27 @@ var shadowd_profileid *string
 var shadowd_profilekey *string
 var shadowd_debug *bool
 var shadowd_rawdata *bool
+var shadowd_sample *float64
+var shadowd_acl *string
+var shadowd_bans *string
+var admin_addr *string
+var shadowd_passedkey *string
+var shadowd_observe *bool
+var shadowd_traceinput *bool
+var shadowd_audit *string
+var shadowd_phpcompat *bool
+var shadowd_docroot *string
+var shadowd_normalize *bool
+var shadowd_jwt *bool
+var shadowd_jwtsecret *string
+var shadowd_redact *bool
+var shadowd_websocket *bool
+var shadowd_graphql *string
+var syslog_network *string
+var syslog_addr *string
+var syslog_format *string
+var webhook_urls *string
+var webhook_secret *string
 
 var shadowServer shadowd.ShadowdConn
 
@@ -65,56 +92,23 @@ func (p *Prox) handle(w http.ResponseWriter, r *http.Request) {
 }
 
 func httpHandlerToHandlerShadowd(next http.HandlerFunc) http.HandlerFunc {
+	protected := shadowServer.Middleware(next)
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
-		shodowdres, err := shadowServer.SendToShadowd(req)
-		newmap := make(map[string]interface{})
-		err = json.Unmarshal([]byte(shodowdres), &newmap)
-		if err != nil {
-			panic(err)
-		}
 		res.Header().Set("X-Ngtech-Proxy", "Shadower")
-		switch int(newmap["status"].(float64)) {
-		case shadowd.STATUS_OK:
-			fmt.Println("Request reported, OK")
-		case shadowd.STATUS_BAD_REQUEST:
-			res.Header().Set("Content-Type", "text/html")
-			res.WriteHeader(400)
-			res.Write([]byte(internalerrorpage))
-			return
-		case shadowd.STATUS_BAD_SIGNATURE:
-			res.Header().Set("Content-Type", "text/html")
-			res.WriteHeader(500)
-			res.Write([]byte(internalerrorpage))
-			return
-		case shadowd.STATUS_BAD_JSON:
-			res.Header().Set("Content-Type", "text/html")
-			res.WriteHeader(500)
-			res.Write([]byte(internalerrorpage))
-			return
-		case shadowd.STATUS_ATTACK:
-			fmt.Println("This is an attack, needs to take action!")
-			res.Header().Set("Content-Type", "text/html")
-			res.WriteHeader(500)
-			res.Write([]byte(internalerrorpage))
-			return
-		case shadowd.STATUS_CRITICAL_ATTACK:
-			fmt.Println("This is a critical attack, needs to take action!")
-			res.Header().Set("Content-Type", "text/html")
-			res.WriteHeader(500)
-			res.Write([]byte(internalerrorpage))
-			return
-		default:
-			fmt.Println("Something werid happen, response code => ", int(newmap["status"].(float64)))
-			res.Header().Set("Content-Type", "text/html")
-			res.WriteHeader(500)
-			res.Write([]byte(internalerrorpage))
-			return
-		}
-		next.ServeHTTP(res, req)
-		return
+		protected.ServeHTTP(res, req)
 	})
 }
 
+func reloadOnHangup(acl *shadowd.AccessList) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		if err := acl.Reload(); err != nil {
+			fmt.Println("Error reloading the access list:", err)
+		}
+	}
+}
+
 func main() {
 	// come constants and usage helper
 	const (
@@ -133,6 +127,27 @@ func main() {
 	shadowd_profilekey = flag.String("shadowd_profilekey", "102030", "It's a key to hash the data")
 	shadowd_debug = flag.Bool("shadowd_debug", false, "Use \"1\" to enable")
 	shadowd_rawdata = flag.Bool("shadowd_rawdata", false, "Log request raw data Use \"1\" to enable")
+	shadowd_acl = flag.String("shadowd_acl", "", "Allow/deny list file evaluated before shadowd, reloaded on SIGHUP")
+	shadowd_bans = flag.String("shadowd_bans", "", "File to persist the local ban list, empty disables banning")
+	shadowd_passedkey = flag.String("shadowd_passedkey", "", "Key to sign the X-Shadowd-Passed header sent to the upstream, see shadowd.VerifyPassed")
+	shadowd_observe = flag.Bool("shadowd_observe", false, "Only report verdicts to the upstream instead of blocking")
+	shadowd_traceinput = flag.Bool("shadowd_traceinput", false, "Send the traceparent trace ID to shadowd as an input")
+	shadowd_audit = flag.String("shadowd_audit", "", "File to write a json line per analysed request to, rotated daily")
+	syslog_network = flag.String("syslog_network", "udp", "Network of the syslog server, udp, tcp or unixgram")
+	syslog_addr = flag.String("syslog_addr", "", "Address of the syslog server attacks are reported to, empty disables it")
+	syslog_format = flag.String("syslog_format", "cef", "Format of the syslog attack reports, cef or leef")
+	webhook_urls = flag.String("webhook_urls", "", "Comma separated urls notified of critical attacks, empty disables it")
+	webhook_secret = flag.String("webhook_secret", "", "Key to sign the webhook notifications")
+	shadowd_phpcompat = flag.Bool("shadowd_phpcompat", false, "Send the same inputs, caller and resource as the PHP connector")
+	shadowd_docroot = flag.String("shadowd_docroot", "/var/www/html", "Document root of the upstream PHP application, used with shadowd_phpcompat")
+	shadowd_normalize = flag.Bool("shadowd_normalize", false, "Also send normalized variants of the inputs to defeat encoding evasions")
+	shadowd_jwt = flag.Bool("shadowd_jwt", false, "Send the claims of bearer tokens to shadowd as JWT inputs")
+	shadowd_jwtsecret = flag.String("shadowd_jwtsecret", "", "HMAC secret to verify bearer tokens with, enables banning by token subject")
+	shadowd_redact = flag.Bool("shadowd_redact", false, "Do not send credentials to shadowd and hash the cookie values")
+	shadowd_websocket = flag.Bool("shadowd_websocket", false, "Also analyse the messages clients send over WebSocket connections")
+	shadowd_graphql = flag.String("shadowd_graphql", "", "Path of the upstream GraphQL endpoint whose arguments are sent as inputs, empty disables it")
+	admin_addr = flag.String("admin_addr", "", "ip:port of the operators interface, empty disables it")
+	shadowd_sample = flag.Float64("shadowd_sample", 100, "Percentage of the requests to analyse, logins and checkouts are always analysed")
 
 	flag.Parse()
 	shadowServer = shadowd.ShadowdConn{ServerAddr: *shadowd_addr,
@@ -141,6 +156,99 @@ func main() {
 		Logfile:    "",
 		Debug:      *shadowd_debug,
 		ProfileKey: *shadowd_profilekey,
+		BlockPage:  internalerrorpage,
+		PassedKey:  *shadowd_passedkey,
+		Observe:    *shadowd_observe,
+		Metrics:    shadowd.NewMetrics(),
+		TraceInput: *shadowd_traceinput,
+		Policy: &shadowd.Policy{
+			Rules: []shadowd.PolicyRule{
+				{PathPrefix: "/login", Action: shadowd.POLICY_ALWAYS},
+				{PathPrefix: "/checkout", Action: shadowd.POLICY_ALWAYS},
+				{PathPrefix: "/static/", Action: shadowd.POLICY_NEVER},
+			},
+			DefaultAction:     shadowd.POLICY_SAMPLE,
+			DefaultSampleRate: *shadowd_sample,
+		},
+	}
+	shadowServer.Normalize = *shadowd_normalize
+	if *shadowd_jwt {
+		shadowServer.JWT = &shadowd.JWTExtractor{}
+		if *shadowd_jwtsecret != "" {
+			shadowServer.JWT.Key = []byte(*shadowd_jwtsecret)
+			shadowServer.BanKey = shadowServer.JWT.BanKey
+		}
+	}
+	if *shadowd_redact {
+		shadowServer.ExcludeHeaders = []string{"Authorization", "Proxy-Authorization"}
+		shadowServer.Redactor = &shadowd.Redactor{
+			HashKey: *shadowd_profilekey,
+			Rules: []shadowd.RedactRule{
+				{Key: "COOKIE|*", Action: shadowd.REDACT_HASH},
+				{Key: "SERVER|HTTP_COOKIE", Action: shadowd.REDACT_DROP},
+			},
+		}
+	}
+	if *shadowd_graphql != "" {
+		shadowServer.GraphQL = &shadowd.GraphQLExtractor{
+			Paths:      []string{*shadowd_graphql},
+			MaxDepth:   12,
+			MaxAliases: 30,
+			MaxSize:    64 * 1024,
+		}
+	}
+	if *shadowd_phpcompat {
+		shadowServer.PHPCompat = true
+		shadowServer.DocumentRoot = *shadowd_docroot
+	}
+	shadowServer.OnAttack(func(req *http.Request, inputs map[string]string, verdict *shadowd.Verdict) {
+		fmt.Println("Attack from", shadowd.ClientIP(req), "on", req.Host+req.URL.Path, "threats:", verdict.Threats)
+	}, true)
+	if *shadowd_acl != "" {
+		acl, err := shadowd.LoadAccessList(*shadowd_acl)
+		if err != nil {
+			panic(err)
+		}
+		shadowServer.AccessList = acl
+		go reloadOnHangup(acl)
+	}
+	if *shadowd_audit != "" {
+		audit, err := shadowd.NewAuditLog(*shadowd_audit)
+		if err != nil {
+			panic(err)
+		}
+		audit.MaxAge = 24 * time.Hour
+		audit.Compress = true
+		audit.Redact = []string{"SERVER|HTTP_AUTHORIZATION", "SERVER|HTTP_COOKIE", "COOKIE|*"}
+		shadowServer.Sinks = append(shadowServer.Sinks, audit)
+	}
+	if *syslog_addr != "" {
+		syslog, err := shadowd.NewSyslogSink(*syslog_network, *syslog_addr, *syslog_format)
+		if err != nil {
+			panic(err)
+		}
+		shadowServer.Sinks = append(shadowServer.Sinks, syslog)
+	}
+	if *webhook_urls != "" {
+		notifier := shadowd.NewWebhookNotifier(strings.Split(*webhook_urls, ",")...)
+		notifier.Profile = *shadowd_profileid
+		notifier.Secret = *webhook_secret
+		shadowServer.Sinks = append(shadowServer.Sinks, notifier)
+	}
+	if *shadowd_bans != "" {
+		bans, err := shadowd.NewBanManager(*shadowd_bans)
+		if err != nil {
+			panic(err)
+		}
+		shadowServer.Bans = bans
+	}
+	if *admin_addr != "" {
+		admin := http.NewServeMux()
+		admin.Handle("/metrics", shadowServer.Metrics)
+		if shadowServer.Bans != nil {
+			admin.Handle("/bans", shadowServer.Bans)
+		}
+		go http.ListenAndServe(*admin_addr, admin)
 	}
 
 	fmt.Printf("server will run on : %s\n", *port)
@@ -149,7 +257,13 @@ func main() {
 	// proxy
 	proxy := New(*url)
 
+	handler := http.Handler(http.HandlerFunc(proxy.handle))
+	if *shadowd_websocket {
+		inspector := &shadowd.WebSocketInspector{Conn: &shadowServer, JSON: true}
+		handler = inspector.Handler(handler)
+	}
+
 	// server
-	http.HandleFunc("/", httpHandlerToHandlerShadowd(proxy.handle))
+	http.HandleFunc("/", httpHandlerToHandlerShadowd(handler.ServeHTTP))
 	http.ListenAndServe(*port, nil)
 }
@@ -0,0 +1,180 @@
+package shadowd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Adds, renames or removes inputs of a request before it is sent to shadowd.
+// Extractors run in order on the same inputs map, so later extractors see
+// and may change what the earlier ones produced. Input keys are
+// "SOURCE|path" with the path escaped, see EscapeKey.
+type InputExtractor interface {
+	Extract(req *http.Request, inputs map[string]string) error
+}
+
+// Adapts a function to an InputExtractor.
+type InputExtractorFunc func(req *http.Request, inputs map[string]string) error
+
+func (fn InputExtractorFunc) Extract(req *http.Request, inputs map[string]string) error {
+	return fn(req, inputs)
+}
+
+// Escapes the "/" and "|" characters of an input path for use in a key.
+func EscapeKey(key string) string {
+	return escapeKey(key)
+}
+
+// Returns the built-in extractors configured from the connection fields,
+// the chain used when ShadowdConn.Extractors is nil. Append to it to keep
+// the default inputs and add custom ones. In PHPCompat mode these are the
+// PHPExtractors, with Routes a RouteExtractor adds the path parameters, the
+// JWT and GraphQL extractors add the token claims and query arguments and
+// with Normalize a NormalizeExtractor runs last.
+func (serverconn *ShadowdConn) DefaultExtractors() []InputExtractor {
+	var extractors []InputExtractor
+	if serverconn.PHPCompat {
+		extractors = serverconn.PHPExtractors()
+	} else {
+		extractors = serverconn.httpExtractors()
+	}
+	if serverconn.Routes != nil {
+		extractors = append(extractors, RouteExtractor{Match: serverconn.Routes})
+	}
+	if serverconn.JWT != nil {
+		extractors = append(extractors, serverconn.JWT)
+	}
+	if serverconn.GraphQL != nil {
+		extractors = append(extractors, serverconn.GraphQL)
+	}
+	if serverconn.Normalize {
+		extractors = append(extractors, NormalizeExtractor{})
+	}
+	return extractors
+}
+
+func (serverconn *ShadowdConn) httpExtractors() []InputExtractor {
+	extractors := []InputExtractor{
+		RemoteAddrExtractor{},
+		QueryExtractor{},
+		CookieExtractor{Upper: serverconn.UpperCookies, Full: serverconn.LogFullCookie},
+		serverconn.headerExtractor(),
+	}
+	if serverconn.ReadBody {
+		extractors = append(extractors, &BodyExtractor{})
+	}
+	return append(extractors, HostExtractor{Debug: serverconn.Debug})
+}
+
+func (serverconn *ShadowdConn) headerExtractor() HeaderExtractor {
+	return HeaderExtractor{Include: serverconn.IncludeHeaders, Exclude: serverconn.ExcludeHeaders}
+}
+
+// Adds the SERVER|HTTP_REMOTEADDR input.
+type RemoteAddrExtractor struct{}
+
+func (RemoteAddrExtractor) Extract(req *http.Request, inputs map[string]string) error {
+	inputs["SERVER|HTTP_REMOTEADDR"] = req.RemoteAddr
+	return nil
+}
+
+// Adds the query arguments as METHOD|name inputs, such as GET|id.
+type QueryExtractor struct{}
+
+func (QueryExtractor) Extract(req *http.Request, inputs map[string]string) error {
+	for k, v := range req.URL.Query() {
+		for _, s := range v {
+			inputs[req.Method+"|"+escapeKey(k)] = s
+		}
+	}
+	return nil
+}
+
+// Adds the cookies as COOKIE|name inputs, with upper cased names when Upper
+// is set. Full also adds all of the cookies as the SERVER|HTTP_COOKIE input.
+type CookieExtractor struct {
+	Upper bool
+	Full  bool
+}
+
+func (extractor CookieExtractor) Extract(req *http.Request, inputs map[string]string) error {
+	cookie := req.Cookies()
+	for _, v := range cookie {
+		if extractor.Upper {
+			inputs["COOKIE|"+escapeKey(strings.ToUpper(v.Name))] = v.Value
+		} else {
+			inputs["COOKIE|"+escapeKey(v.Name)] = v.Value
+		}
+	}
+	if extractor.Full {
+		inputs["SERVER|HTTP_COOKIE"] = ""
+		for _, v := range cookie {
+			inputs["SERVER|HTTP_COOKIE"] = inputs["SERVER|HTTP_COOKIE"] + v.Name + "=" + v.Value + "; "
+		}
+		if len(inputs["SERVER|HTTP_COOKIE"]) == 0 {
+			delete(inputs, "SERVER|HTTP_COOKIE")
+		}
+	}
+	return nil
+}
+
+// Adds the headers as SERVER|HTTP_NAME inputs, such as SERVER|HTTP_USER_AGENT.
+// When Include is set only the headers matching one of its globs are added
+// and headers matching a glob of Exclude are never added, such as
+// "Authorization" or "X-Api-*".
+type HeaderExtractor struct {
+	Include []string
+	Exclude []string
+}
+
+func (extractor HeaderExtractor) Extract(req *http.Request, inputs map[string]string) error {
+	headers := req.Header
+	for k, v := range headers {
+		if len(extractor.Include) > 0 && !matchHeader(extractor.Include, k) || matchHeader(extractor.Exclude, k) {
+			continue
+		}
+		inputs["SERVER|HTTP_"+escapeKey(strings.Replace(strings.ToUpper(k), "-", "_", -1))] = strings.Join(v, "")
+	}
+	return nil
+}
+
+// Adds the body of non GET requests as the DATA|raw input.
+// The body is replaced with a readable copy for the next handlers.
+type BodyExtractor struct{}
+
+func (*BodyExtractor) Extract(req *http.Request, inputs map[string]string) error {
+	if req.Method == "GET" || req.Body == nil {
+		return nil
+	}
+	contents, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+	inputs["DATA|raw"] = string(contents)
+	// Ne need to make the body readable again
+	req.Body = ioutil.NopCloser(bytes.NewBufferString(inputs["DATA|raw"]))
+	return nil
+}
+
+// Adds the SERVER|HTTP_HOST and SERVER|HTTP_PORT inputs.
+type HostExtractor struct {
+	Debug bool
+}
+
+func (extractor HostExtractor) Extract(req *http.Request, inputs map[string]string) error {
+	host, port, err := net.SplitHostPort(req.Host)
+	if err != nil && extractor.Debug {
+		fmt.Println("Error parsing server host+port", err)
+	}
+	if host != "" {
+		inputs["SERVER|HTTP_HOST"] = host
+		inputs["SERVER|HTTP_PORT"] = port
+	} else {
+		inputs["SERVER|HTTP_HOST"] = req.Host
+	}
+	return nil
+}
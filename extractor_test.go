@@ -0,0 +1,56 @@
+package shadowd
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestBuildPayload(t *testing.T) {
+	req, serverconn := baselineRequest()
+	payload, err := serverconn.BuildPayload(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := payload.Sign(serverconn.ProfileId, serverconn.ProfileKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(signed.Data) != baselineData || signed.Signature != baselineSignature {
+		t.Errorf("got %s %s\nwant %s %s", signed.Signature, signed.Data, baselineSignature, baselineData)
+	}
+}
+
+func TestExtractorChain(t *testing.T) {
+	req, serverconn := baselineRequest()
+	failure := errors.New("extractor failed")
+	serverconn.Extractors = append(serverconn.DefaultExtractors(), InputExtractorFunc(func(req *http.Request, inputs map[string]string) error {
+		delete(inputs, "SERVER|HTTP_REMOTEADDR")
+		inputs["CUSTOM|"+EscapeKey("a/b")] = inputs["POST|x"]
+		return nil
+	}))
+	payload, err := serverconn.BuildPayload(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := payload.Input["SERVER|HTTP_REMOTEADDR"]; ok || payload.Input["CUSTOM|a\\/b"] != "1" {
+		t.Errorf("custom extractor did not run after the built-ins: %q", payload.Input)
+	}
+
+	req, serverconn = baselineRequest()
+	serverconn.Extractors = []InputExtractor{QueryExtractor{}}
+	payload, err = serverconn.BuildPayload(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"POST|x": "1", "POST|y\\/z": "'", "POST|p\\|q": "2"}
+	if !reflect.DeepEqual(payload.Input, want) {
+		t.Errorf("got %q, want %q", payload.Input, want)
+	}
+
+	serverconn.Extractors = []InputExtractor{InputExtractorFunc(func(*http.Request, map[string]string) error { return failure })}
+	if _, err := serverconn.BuildPayload(req); err != failure {
+		t.Errorf("got %v, want the extractor error", err)
+	}
+}
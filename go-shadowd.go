@@ -5,17 +5,11 @@
 package shadowd
 
 import (
-	"bufio"
-	"bytes"
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/hex"
-	"encoding/json"
+	"context"
 	"fmt"
-	"io/ioutil"
-	"net"
 	"net/http"
 	"strings"
+	"time"
 )
 
 // Global default settings constants
@@ -45,6 +39,66 @@ type ShadowdConn struct {
 	Logfile       string
 	Debug         bool
 	LogFullCookie bool
+	// Decides which requests are analysed, nil analyses every request.
+	Policy *Policy
+	// Local allow and deny lists evaluated before contacting shadowd.
+	AccessList *AccessList
+	// Bans clients locally after repeated attack verdicts.
+	Bans *BanManager
+	// Returns the key a client is banned by besides its client IP, such as
+	// JWTExtractor.BanKey. Nil or an empty key bans by the client IP only.
+	BanKey func(req *http.Request) string
+	// Collects verdict, error, latency and payload size metrics.
+	Metrics *Metrics
+	// Creates a span around every check, nil disables tracing.
+	Tracer Tracer
+	// Sends the trace ID of the request as the SERVER|TRACE_ID input.
+	TraceInput bool
+	// Receive an Event after every check, such as the AuditLog.
+	Sinks []Sink
+	// Sends the signed payloads, nil uses a TCPTransport to ServerAddr.
+	Transport Transport
+	// Build the inputs of a request, nil uses the DefaultExtractors.
+	Extractors []InputExtractor
+	// Reproduces the inputs, caller and resource of the PHP connector.
+	PHPCompat bool
+	// The document root used for the PHP SCRIPT_FILENAME.
+	DocumentRoot string
+	// Adds normalized variants of the inputs, see NormalizeExtractor.
+	Normalize bool
+	// How invalid UTF-8 inputs are encoded, one of the ENCODING_X values.
+	BinaryEncoding int
+	// One of the CALLER_X strategies, CallerFunc is used by CALLER_FUNC.
+	CallerStrategy int
+	CallerFunc     func(req *http.Request) string
+	// Matches requests to route templates, which become the caller while
+	// the path parameters are sent as PATH inputs.
+	Routes RouteMatcher
+	// Sends the claims of JSON Web Tokens as JWT inputs.
+	JWT *JWTExtractor
+	// Sends the arguments of GraphQL requests as GQL inputs, with the
+	// operation name as the caller.
+	GraphQL *GraphQLExtractor
+	// Globs of the header names sent, nil sends all of them, and not sent.
+	IncludeHeaders []string
+	ExcludeHeaders []string
+	// Drops, hashes or truncates inputs, and the matching query arguments
+	// of the request URIs and the event URL, before they are sent, logged
+	// or printed as debug output.
+	Redactor *Redactor
+	// The html page sent by the Middleware to blocked clients.
+	BlockPage string
+	// When set the Middleware signs forwarded requests with a passed header.
+	PassedKey string
+	// When set the Middleware passes every request to the next handler and
+	// only reports the verdict through the request context. The SQLDriver,
+	// the RoundTripper, the WebSocketInspector and the GRPCInspector only
+	// log the queries, requests, messages and calls they would reject, the
+	// inspectors still end connections and calls on size limits and
+	// protocol errors.
+	Observe bool
+
+	hooks []hook
 }
 
 func escapeKey(key string) string {
@@ -68,123 +122,135 @@ func unescapeKey(key string) string {
 // The error is always nil unless some special parsing or communication happen.
 // It is up to the developer what to do for each error and status code.
 func (serverconn *ShadowdConn) SendToShadowd(req *http.Request) (string, error) {
-	newmap := make(map[string]interface{})
-	inputmap := make(map[string]string)
-	newmap["version"] = SHADOWD_CONNECTOR_VERSION
-	newmap["client_ip"] = strings.Split(req.RemoteAddr, ":")[0]
-	newmap["caller"] = req.URL.Path
-	newmap["resource"] = req.URL.Path
-
-	inputmap["SERVER|HTTP_REMOTEADDR"] = req.RemoteAddr
+	line, _, err := serverconn.send(req)
+	return line, err
+}
 
-	for k, v := range req.URL.Query() {
-		for _, s := range v {
-			inputmap[req.Method+"|"+escapeKey(k)] = s
-		}
+// Returns the reply line and the parsed verdict, which is nil when the
+// reply could not be parsed.
+func (serverconn *ShadowdConn) send(req *http.Request) (string, *Verdict, error) {
+	span, traceId := serverconn.startSpan(req)
+	event := newEvent(req)
+	event.URL = serverconn.Redactor.RedactURI(req.Method, event.URL)
+	line, verdict, err := serverconn.sendToShadowd(req, span, traceId, event)
+	if err != nil {
+		span.RecordError(err)
+		event.Error = err.Error()
+		serverconn.runErrorHooks(req, event.Inputs, err)
 	}
+	span.End()
+	serverconn.emit(event)
+	return line, verdict, err
+}
 
-	cookie := req.Cookies()
-	for _, v := range cookie {
-		if serverconn.UpperCookies {
-			inputmap["COOKIE|"+escapeKey(strings.ToUpper(v.Name))] = v.Value
-		} else {
-			inputmap["COOKIE|"+escapeKey(v.Name)] = v.Value
-		}
+func (serverconn *ShadowdConn) sendToShadowd(req *http.Request, span Span, traceId string, event *Event) (string, *Verdict, error) {
+	payload, err := serverconn.buildPayload(req, span, traceId)
+	if err != nil {
+		return "", nil, err
 	}
-	if serverconn.LogFullCookie {
-		inputmap["SERVER|HTTP_COOKIE"] = ""
-		for _, v := range cookie {
-			inputmap["SERVER|HTTP_COOKIE"] = inputmap["SERVER|HTTP_COOKIE"] + v.Name + "=" + v.Value + "; "
-		}
-		if len(inputmap["SERVER|HTTP_COOKIE"]) == 0 {
-			delete(inputmap, "SERVER|HTTP_COOKIE")
-		}
+	event.Caller = payload.Caller
+	event.Resource = payload.Resource
+	event.Inputs = payload.Input
+	event.Lossy = payload.Lossy
+
+	line, verdict, err := serverconn.exchange(req.Context(), payload, span, event)
+	if err != nil || verdict == nil {
+		return line, nil, err
 	}
-	headers := req.Header
-	for k, v := range headers {
-		inputmap["SERVER|HTTP_"+escapeKey(strings.Replace(strings.ToUpper(k), "-", "_", -1))] = strings.Join(v, "")
+	serverconn.runVerdictHooks(req, payload.Input, verdict)
+	serverconn.recordBan(req, verdict)
+	return line, verdict, nil
+}
+
+// Builds the payload that SendToShadowd would send for the request, without
+// contacting shadowd. When ReadBody is set the body is read and replaced
+// with a readable copy.
+func (serverconn *ShadowdConn) BuildPayload(req *http.Request) (*Payload, error) {
+	tc, _ := ParseTraceparent(req.Header.Get("Traceparent"))
+	return serverconn.buildPayload(req, noopSpan{}, tc.TraceId)
+}
+
+func (serverconn *ShadowdConn) buildPayload(req *http.Request, span Span, traceId string) (*Payload, error) {
+	inputmap := make(map[string]string)
+	payload := &Payload{
+		Version:  SHADOWD_CONNECTOR_VERSION,
+		ClientIP: ClientIP(req),
+		Caller:   serverconn.Caller(req),
+		Resource: serverconn.Resource(req),
+		Input:    inputmap,
+		Hashes:   make(map[string]string),
 	}
 
-	if req.Method != "GET" && serverconn.ReadBody {
-		contents, err := ioutil.ReadAll(req.Body)
+	extractors := serverconn.Extractors
+	if extractors == nil {
+		extractors = serverconn.DefaultExtractors()
+	}
+	for _, extractor := range extractors {
+		extractStart := time.Now()
+		err := extractor.Extract(req, inputmap)
+		if _, ok := extractor.(*BodyExtractor); ok {
+			span.SetAttribute("shadowd.body_read_ms", float64(time.Since(extractStart))/float64(time.Millisecond))
+		}
 		if err != nil {
-			return "", err
-		} else {
-			inputmap["DATA|raw"] = string(contents)
-			// Ne need to make the body readable again
-			req.Body = ioutil.NopCloser(bytes.NewBufferString(inputmap["DATA|raw"]))
+			return nil, err
 		}
 	}
-	host, port, err := net.SplitHostPort(req.Host)
-	if err != nil && serverconn.Debug {
-		fmt.Println("Error parsing server host+port", err)
+	if serverconn.TraceInput && traceId != "" {
+		inputmap["SERVER|TRACE_ID"] = traceId
 	}
-	if host != "" {
-		inputmap["SERVER|HTTP_HOST"] = host
-		inputmap["SERVER|HTTP_PORT"] = port
-	} else {
-		inputmap["SERVER|HTTP_HOST"] = req.Host
-	}
-	newmap["input"] = inputmap
-
-	jsonData, err := json.Marshal(inputmap)
-	if err != nil {
-		fmt.Println("JSON marshaling failed:", err)
-		return "", err
-	}
-
-	hash := make(map[string]string)
-
-	//mac := hmac.New(sha256.New, nil)
-	//mac.Write([]byte(unescapeKey(string(jsonData))))
-	//expectedMAC := hex.EncodeToString(mac.Sum(nil))
-	//hash["sha256"] = expectedMAC
-
-	newmap["hashes"] = hash
+	serverconn.Redactor.RedactRequest(req, inputmap)
+	payload.Resource = serverconn.Redactor.RedactURI(req.Method, payload.Resource)
+	serverconn.encodeInputs(requestCharset(req), payload)
+	return payload, nil
+}
 
-	jsonData, err = json.Marshal(newmap)
+// Signs and sends the payload through the Transport and parses the reply.
+// The verdict is nil when the reply could not be parsed, which is recorded
+// in the event but is not an error to keep the SendToShadowd behaviour.
+func (serverconn *ShadowdConn) exchange(ctx context.Context, payload *Payload, span Span, event *Event) (string, *Verdict, error) {
+	signed, err := payload.Sign(serverconn.ProfileId, serverconn.ProfileKey)
 	if err != nil {
 		fmt.Println("JSON marshaling failed:", err)
-		return "", err
+		return "", nil, err
 	}
-
-	mac := hmac.New(sha256.New, []byte(serverconn.ProfileKey))
-	newjson := []byte(unescapeKey(string(jsonData)))
-	mac.Write(newjson)
-	expectedMAC := hex.EncodeToString(mac.Sum(nil))
 	if serverconn.Debug {
-		fmt.Printf("%v\n%v\n%v\n", serverconn.ProfileId, expectedMAC, string(newjson))
+		fmt.Printf("%v\n%v\n%v\n", signed.ProfileId, signed.Signature, unescapeKey(string(signed.Data)))
 	}
-	//send the fomratted string into the shadowd server at port 9115
 
-	tcpAddr, err := net.ResolveTCPAddr("tcp", serverconn.ServerAddr)
+	serverconn.Metrics.RecordPayload(len(signed.Data))
+	span.SetAttribute("shadowd.payload_bytes", len(signed.Data))
+	start := time.Now()
+	line, err := serverconn.transport().Send(ctx, signed)
 	if err != nil {
-		fmt.Println("ResolveTCPAddr failed:", err.Error())
-		return "", err
+		serverconn.Metrics.RecordError(errorClass(err))
+		return "", nil, err
 	}
-	conn, err := net.DialTCP("tcp", nil, tcpAddr)
-	if err != nil {
-		fmt.Println("Couldn't connect to server:", tcpAddr, err.Error())
-		return "", err
-	}
-	defer conn.Close()
+	event.Latency = time.Since(start)
+	serverconn.Metrics.RecordLatency(serverconn.ServerAddr, event.Latency)
 
-	// Sending data to the server
-	_, err = fmt.Fprintf(conn, "%s\n%s\n%s\n", serverconn.ProfileId, expectedMAC, string(jsonData))
-	if err != nil {
-		fmt.Println("Error writing to the server:", err.Error())
-		return "", err
+	if serverconn.Debug {
+		fmt.Println("reply from server=", line)
 	}
-
-	reader := bufio.NewReader(conn)
-	line, err := reader.ReadString('\n')
+	verdict, err := ParseVerdict(line)
 	if err != nil {
-		fmt.Println("Error reading from the server:", err.Error())
-		return "", err
+		serverconn.Metrics.RecordError(ERROR_PROTOCOL)
+		event.Error = "invalid reply: " + err.Error()
+		return line, nil, nil
 	}
+	verdict.Server = serverconn.ServerAddr
+	verdict.Latency = event.Latency
+	verdict.Lossy = payload.Lossy
+	event.Status = verdict.Status
+	event.Threats = verdict.Threats
+	serverconn.Metrics.RecordVerdict(verdict.Status)
+	span.SetAttribute("shadowd.status", verdict.Status)
+	span.SetAttribute("shadowd.threat_count", len(verdict.Threats))
+	return line, verdict, nil
+}
 
-	if serverconn.Debug {
-		fmt.Println("reply from server=", line)
+func (serverconn *ShadowdConn) transport() Transport {
+	if serverconn.Transport != nil {
+		return serverconn.Transport
 	}
-	return line, nil
+	return &TCPTransport{Addr: serverconn.ServerAddr}
 }
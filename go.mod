@@ -0,0 +1,5 @@
+module github.com/elico/go-shadowd
+
+go 1.22
+
+require golang.org/x/text v0.21.0
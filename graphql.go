@@ -0,0 +1,683 @@
+package shadowd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Hard limits protecting the parser and the inputs from hostile documents,
+// whatever the limits of the GraphQLExtractor. GRAPHQL_MAX_FIELDS bounds
+// the fields, fragment spreads and inline fragments visited while expanding
+// fragments.
+const (
+	GRAPHQL_MAX_NESTING = 128
+	GRAPHQL_MAX_INPUTS  = 10000
+	GRAPHQL_MAX_FIELDS  = 10000
+)
+
+// Returned by the GraphQLExtractor for documents that cannot be parsed or
+// exceed one of its limits. The Middleware answers them with a
+// STATUS_BAD_REQUEST verdict without contacting shadowd.
+type GraphQLError struct {
+	Reason string
+}
+
+func (err *GraphQLError) Error() string {
+	return "shadowd: graphql " + err.Reason
+}
+
+// Parses the GraphQL requests sent to Paths, "/graphql" when empty, as a
+// json body, an application/graphql body or GET query arguments.
+// Every argument value is sent as an input keyed by its field path, such as
+// GQL|createUser|input|email for createUser(input: {email: "..."}).
+// Variables are sent in place of the arguments using them and unused ones
+// as GQL|$name. Fragments are expanded, aliases are ignored in the keys so
+// the same field always has the same key and repeated fields are numbered
+// like GQL|user#1|id. Directive arguments are keyed like GQL|user|@include|if.
+//
+// MaxDepth limits the nesting of the selected fields, MaxAliases the number
+// of aliased fields and MaxSize the length of the query, zero disables the
+// matching limit.
+type GraphQLExtractor struct {
+	Paths      []string
+	MaxDepth   int
+	MaxAliases int
+	MaxSize    int
+}
+
+type graphqlRequest struct {
+	Query         string                     `json:"query"`
+	OperationName string                     `json:"operationName"`
+	Variables     map[string]json.RawMessage `json:"variables"`
+}
+
+func (extractor *GraphQLExtractor) Extract(req *http.Request, inputs map[string]string) error {
+	gqlreq, err := extractor.request(req)
+	if gqlreq == nil || err != nil {
+		return err
+	}
+	doc, err := extractor.parse(gqlreq.Query)
+	if err != nil {
+		return err
+	}
+	walker := &graphqlWalker{
+		extractor: extractor,
+		doc:       doc,
+		variables: gqlreq.Variables,
+		used:      make(map[string]bool),
+		seen:      make(map[string]int),
+		inputs:    inputs,
+	}
+	found := false
+	for _, op := range doc.operations {
+		if gqlreq.OperationName == "" || op.name == gqlreq.OperationName {
+			found = true
+			walker.op = op
+			if err := walker.walk(op.selections, "GQL", 0, nil); err != nil {
+				return err
+			}
+		}
+	}
+	if !found {
+		return &GraphQLError{Reason: "unknown operation " + gqlreq.OperationName}
+	}
+	for name, value := range gqlreq.Variables {
+		if !walker.used[name] {
+			walker.addJSON("GQL|$"+escapeKey(name), value)
+		}
+	}
+	return walker.err
+}
+
+// Returns the name of the requested operation, the one of the document
+// when it has a single operation, or an empty string.
+func (extractor *GraphQLExtractor) OperationName(req *http.Request) string {
+	gqlreq, err := extractor.request(req)
+	if gqlreq == nil || err != nil {
+		return ""
+	}
+	if gqlreq.OperationName != "" {
+		return gqlreq.OperationName
+	}
+	doc, err := extractor.parse(gqlreq.Query)
+	if err != nil || len(doc.operations) != 1 {
+		return ""
+	}
+	return doc.operations[0].name
+}
+
+// Returns the GraphQL request or nil when req is not one.
+func (extractor *GraphQLExtractor) request(req *http.Request) (*graphqlRequest, error) {
+	paths := extractor.Paths
+	if len(paths) == 0 {
+		paths = []string{"/graphql"}
+	}
+	matched := false
+	for _, p := range paths {
+		matched = matched || req.URL.Path == p
+	}
+	if !matched {
+		return nil, nil
+	}
+
+	gqlreq := &graphqlRequest{}
+	if req.Method == "GET" {
+		query := req.URL.Query()
+		gqlreq.Query = query.Get("query")
+		gqlreq.OperationName = query.Get("operationName")
+		if variables := query.Get("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &gqlreq.Variables); err != nil {
+				return nil, &GraphQLError{Reason: "variables are not a json object"}
+			}
+		}
+	} else {
+		if req.Body == nil {
+			return nil, nil
+		}
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		mediatype, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if mediatype == "application/graphql" {
+			gqlreq.Query = string(body)
+		} else if err := json.Unmarshal(body, gqlreq); err != nil {
+			return nil, &GraphQLError{Reason: "request is not a json object"}
+		}
+	}
+	if gqlreq.Query == "" {
+		return nil, nil
+	}
+	if extractor.MaxSize > 0 && len(gqlreq.Query) > extractor.MaxSize {
+		return nil, &GraphQLError{Reason: fmt.Sprintf("query of %d bytes exceeds %d", len(gqlreq.Query), extractor.MaxSize)}
+	}
+	return gqlreq, nil
+}
+
+func (extractor *GraphQLExtractor) parse(query string) (*graphqlDocument, error) {
+	parser := &graphqlParser{src: query}
+	parser.next()
+	doc := parser.document()
+	if parser.err != nil {
+		return nil, parser.err
+	}
+	return doc, nil
+}
+
+// Adds the inputs of the selections of an operation.
+type graphqlWalker struct {
+	extractor *GraphQLExtractor
+	doc       *graphqlDocument
+	op        *graphqlOperation
+	variables map[string]json.RawMessage
+	used      map[string]bool
+	seen      map[string]int
+	fields    int
+	aliases   int
+	inputs    map[string]string
+	err       error
+}
+
+func (walker *graphqlWalker) walk(selections []*graphqlSelection, path string, depth int, fragments []string) error {
+	for _, sel := range selections {
+		walker.fields++
+		if walker.fields > GRAPHQL_MAX_FIELDS {
+			return &GraphQLError{Reason: "too many fields"}
+		}
+		switch {
+		case sel.spread != "":
+			for _, name := range fragments {
+				if name == sel.spread {
+					return &GraphQLError{Reason: "fragment cycle through " + name}
+				}
+			}
+			fragment, ok := walker.doc.fragments[sel.spread]
+			if !ok {
+				return &GraphQLError{Reason: "unknown fragment " + sel.spread}
+			}
+			if err := walker.walk(fragment, path, depth, append(fragments, sel.spread)); err != nil {
+				return err
+			}
+			continue
+		case sel.name == "":
+			if err := walker.walk(sel.selections, path, depth, fragments); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if sel.alias != "" {
+			walker.aliases++
+			if max := walker.extractor.MaxAliases; max > 0 && walker.aliases > max {
+				return &GraphQLError{Reason: fmt.Sprintf("more than %d aliases", max)}
+			}
+		}
+		if max := walker.extractor.MaxDepth; max > 0 && depth+1 > max {
+			return &GraphQLError{Reason: fmt.Sprintf("depth exceeds %d", max)}
+		}
+		fieldpath := path + "|" + escapeKey(sel.name)
+		if n := walker.seen[fieldpath]; n > 0 {
+			walker.seen[fieldpath] = n + 1
+			fieldpath += "#" + strconv.Itoa(n)
+		} else {
+			walker.seen[fieldpath] = 1
+		}
+		for _, arg := range sel.arguments {
+			walker.addValue(fieldpath+"|"+escapeKey(arg.name), arg.value)
+		}
+		for _, directive := range sel.directives {
+			for _, arg := range directive.arguments {
+				walker.addValue(fieldpath+"|@"+escapeKey(directive.name)+"|"+escapeKey(arg.name), arg.value)
+			}
+		}
+		if err := walker.walk(sel.selections, fieldpath, depth+1, fragments); err != nil {
+			return err
+		}
+		if walker.err != nil {
+			return walker.err
+		}
+	}
+	return nil
+}
+
+func (walker *graphqlWalker) addValue(key string, value interface{}) {
+	switch v := value.(type) {
+	case graphqlVariable:
+		walker.used[string(v)] = true
+		if raw, ok := walker.variables[string(v)]; ok {
+			walker.addJSON(key, raw)
+		} else if def, ok := walker.op.defaults[string(v)]; ok {
+			walker.addValue(key, def)
+		}
+	case []interface{}:
+		for i, member := range v {
+			walker.addValue(key+"|"+strconv.Itoa(i), member)
+		}
+	case []graphqlArgument:
+		for _, field := range v {
+			walker.addValue(key+"|"+escapeKey(field.name), field.value)
+		}
+	case string:
+		walker.add(key, v)
+	}
+}
+
+func (walker *graphqlWalker) addJSON(key string, raw json.RawMessage) {
+	var value interface{}
+	if json.Unmarshal(raw, &value) != nil {
+		walker.add(key, string(raw))
+		return
+	}
+	flattenJSON(key, value, walker.inputs)
+	if len(walker.inputs) > GRAPHQL_MAX_INPUTS {
+		walker.err = &GraphQLError{Reason: "too many inputs"}
+	}
+}
+
+func (walker *graphqlWalker) add(key, value string) {
+	walker.inputs[key] = value
+	if len(walker.inputs) > GRAPHQL_MAX_INPUTS {
+		walker.err = &GraphQLError{Reason: "too many inputs"}
+	}
+}
+
+// The parsed document. Argument values are strings for scalars and enums,
+// graphqlVariable, []interface{} for lists and []graphqlArgument for
+// objects.
+type graphqlDocument struct {
+	operations []*graphqlOperation
+	fragments  map[string][]*graphqlSelection
+}
+
+type graphqlOperation struct {
+	kind       string
+	name       string
+	defaults   map[string]interface{}
+	selections []*graphqlSelection
+}
+
+// A field, a fragment spread when spread is set, or an inline fragment
+// when name is empty.
+type graphqlSelection struct {
+	alias      string
+	name       string
+	arguments  []graphqlArgument
+	directives []graphqlDirective
+	selections []*graphqlSelection
+	spread     string
+}
+
+type graphqlArgument struct {
+	name  string
+	value interface{}
+}
+
+type graphqlDirective struct {
+	name      string
+	arguments []graphqlArgument
+}
+
+type graphqlVariable string
+
+const (
+	gqlEOF = iota
+	gqlPunct
+	gqlName
+	gqlNumber
+	gqlString
+)
+
+// A recursive descent parser of GraphQL executable documents.
+type graphqlParser struct {
+	src     string
+	pos     int
+	kind    int
+	token   string
+	nesting int
+	err     error
+}
+
+func (parser *graphqlParser) fail(format string, args ...interface{}) {
+	if parser.err == nil {
+		parser.err = &GraphQLError{Reason: fmt.Sprintf(format, args...)}
+	}
+	parser.kind, parser.token = gqlEOF, ""
+}
+
+// Reads the next token.
+func (parser *graphqlParser) next() {
+	if parser.err != nil {
+		return
+	}
+	src := parser.src
+	for parser.pos < len(src) {
+		c := src[parser.pos]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',' {
+			parser.pos++
+		} else if c == '#' {
+			for parser.pos < len(src) && src[parser.pos] != '\n' && src[parser.pos] != '\r' {
+				parser.pos++
+			}
+		} else if strings.HasPrefix(src[parser.pos:], "\ufeff") {
+			parser.pos += 3
+		} else {
+			break
+		}
+	}
+	if parser.pos >= len(src) {
+		parser.kind, parser.token = gqlEOF, ""
+		return
+	}
+	start := parser.pos
+	c := src[start]
+	switch {
+	case strings.HasPrefix(src[start:], "..."):
+		parser.pos += 3
+		parser.kind, parser.token = gqlPunct, "..."
+	case strings.IndexByte("!$&()=:@[]{}|", c) >= 0:
+		parser.pos++
+		parser.kind, parser.token = gqlPunct, src[start:parser.pos]
+	case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		for parser.pos < len(src) && isGraphQLNameChar(src[parser.pos]) {
+			parser.pos++
+		}
+		parser.kind, parser.token = gqlName, src[start:parser.pos]
+	case c == '-' || c >= '0' && c <= '9':
+		parser.pos++
+		for parser.pos < len(src) && strings.IndexByte("0123456789.eE+-", src[parser.pos]) >= 0 {
+			parser.pos++
+		}
+		parser.kind, parser.token = gqlNumber, src[start:parser.pos]
+	case c == '"':
+		parser.kind = gqlString
+		if strings.HasPrefix(src[start:], `"""`) {
+			parser.token = parser.blockString()
+		} else {
+			parser.token = parser.quotedString()
+		}
+	default:
+		parser.fail("unexpected character %q at %d", c, start)
+	}
+}
+
+func isGraphQLNameChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+func (parser *graphqlParser) quotedString() string {
+	var value strings.Builder
+	src := parser.src
+	parser.pos++
+	for parser.pos < len(src) {
+		c := src[parser.pos]
+		switch {
+		case c == '"':
+			parser.pos++
+			return value.String()
+		case c == '\n' || c == '\r':
+			parser.fail("unterminated string")
+			return ""
+		case c == '\\' && parser.pos+1 < len(src):
+			escaped := src[parser.pos+1]
+			parser.pos += 2
+			switch escaped {
+			case 'n':
+				value.WriteByte('\n')
+			case 't':
+				value.WriteByte('\t')
+			case 'r':
+				value.WriteByte('\r')
+			case 'b':
+				value.WriteByte('\b')
+			case 'f':
+				value.WriteByte('\f')
+			case 'u':
+				if parser.pos+4 > len(src) {
+					parser.fail("invalid unicode escape")
+					return ""
+				}
+				code, err := strconv.ParseUint(src[parser.pos:parser.pos+4], 16, 16)
+				if err != nil {
+					parser.fail("invalid unicode escape")
+					return ""
+				}
+				value.WriteRune(rune(code))
+				parser.pos += 4
+			default:
+				value.WriteByte(escaped)
+			}
+		default:
+			_, size := utf8.DecodeRuneInString(src[parser.pos:])
+			value.WriteString(src[parser.pos : parser.pos+size])
+			parser.pos += size
+		}
+	}
+	parser.fail("unterminated string")
+	return ""
+}
+
+func (parser *graphqlParser) blockString() string {
+	src := parser.src
+	parser.pos += 3
+	var value strings.Builder
+	for parser.pos < len(src) {
+		if strings.HasPrefix(src[parser.pos:], `\"""`) {
+			value.WriteString(`"""`)
+			parser.pos += 4
+		} else if strings.HasPrefix(src[parser.pos:], `"""`) {
+			parser.pos += 3
+			return value.String()
+		} else {
+			value.WriteByte(src[parser.pos])
+			parser.pos++
+		}
+	}
+	parser.fail("unterminated block string")
+	return ""
+}
+
+func (parser *graphqlParser) is(kind int, token string) bool {
+	return parser.kind == kind && parser.token == token
+}
+
+// Consumes the punctuator or returns false.
+func (parser *graphqlParser) skip(token string) bool {
+	if parser.is(gqlPunct, token) {
+		parser.next()
+		return true
+	}
+	return false
+}
+
+func (parser *graphqlParser) expect(token string) {
+	if !parser.skip(token) {
+		parser.fail("expected %q at %d", token, parser.pos)
+	}
+}
+
+func (parser *graphqlParser) name() string {
+	if parser.kind != gqlName {
+		parser.fail("expected a name at %d", parser.pos)
+		return ""
+	}
+	name := parser.token
+	parser.next()
+	return name
+}
+
+// Guards the recursion against deeply nested documents.
+func (parser *graphqlParser) enter() bool {
+	parser.nesting++
+	if parser.nesting > GRAPHQL_MAX_NESTING {
+		parser.fail("document nested deeper than %d", GRAPHQL_MAX_NESTING)
+		return false
+	}
+	return true
+}
+
+func (parser *graphqlParser) document() *graphqlDocument {
+	doc := &graphqlDocument{fragments: make(map[string][]*graphqlSelection)}
+	for parser.kind != gqlEOF {
+		switch {
+		case parser.is(gqlPunct, "{"):
+			doc.operations = append(doc.operations, &graphqlOperation{kind: "query", selections: parser.selectionSet()})
+		case parser.is(gqlName, "query") || parser.is(gqlName, "mutation") || parser.is(gqlName, "subscription"):
+			doc.operations = append(doc.operations, parser.operation())
+		case parser.is(gqlName, "fragment"):
+			parser.next()
+			name := parser.name()
+			if parser.kind == gqlName && parser.token == "on" {
+				parser.next()
+				parser.name()
+			} else {
+				parser.fail("expected a type condition at %d", parser.pos)
+			}
+			parser.directives()
+			doc.fragments[name] = parser.selectionSet()
+		default:
+			parser.fail("unexpected %q at %d", parser.token, parser.pos)
+		}
+	}
+	if parser.err == nil && len(doc.operations) == 0 {
+		parser.fail("document without operations")
+	}
+	return doc
+}
+
+func (parser *graphqlParser) operation() *graphqlOperation {
+	op := &graphqlOperation{kind: parser.token, defaults: make(map[string]interface{})}
+	parser.next()
+	if parser.kind == gqlName {
+		op.name = parser.name()
+	}
+	if parser.skip("(") {
+		for parser.err == nil && !parser.skip(")") {
+			parser.expect("$")
+			name := parser.name()
+			parser.expect(":")
+			parser.typeReference()
+			if parser.skip("=") {
+				op.defaults[name] = parser.value()
+			}
+			parser.directives()
+		}
+	}
+	parser.directives()
+	op.selections = parser.selectionSet()
+	return op
+}
+
+func (parser *graphqlParser) typeReference() {
+	if !parser.enter() {
+		return
+	}
+	if parser.skip("[") {
+		parser.typeReference()
+		parser.expect("]")
+	} else {
+		parser.name()
+	}
+	parser.skip("!")
+	parser.nesting--
+}
+
+func (parser *graphqlParser) selectionSet() []*graphqlSelection {
+	var selections []*graphqlSelection
+	if !parser.enter() {
+		return nil
+	}
+	parser.expect("{")
+	if parser.is(gqlPunct, "}") {
+		parser.fail("empty selection set at %d", parser.pos)
+	}
+	for parser.err == nil && !parser.skip("}") {
+		sel := &graphqlSelection{}
+		if parser.skip("...") {
+			if parser.kind == gqlName && parser.token != "on" {
+				sel.spread = parser.name()
+				parser.directives()
+			} else {
+				if parser.kind == gqlName {
+					parser.next()
+					parser.name()
+				}
+				sel.directives = parser.directives()
+				sel.selections = parser.selectionSet()
+			}
+		} else {
+			sel.name = parser.name()
+			if parser.skip(":") {
+				sel.alias, sel.name = sel.name, parser.name()
+			}
+			sel.arguments = parser.arguments()
+			sel.directives = parser.directives()
+			if parser.is(gqlPunct, "{") {
+				sel.selections = parser.selectionSet()
+			}
+		}
+		selections = append(selections, sel)
+	}
+	parser.nesting--
+	return selections
+}
+
+func (parser *graphqlParser) arguments() []graphqlArgument {
+	var arguments []graphqlArgument
+	if !parser.skip("(") {
+		return nil
+	}
+	for parser.err == nil && !parser.skip(")") {
+		name := parser.name()
+		parser.expect(":")
+		arguments = append(arguments, graphqlArgument{name: name, value: parser.value()})
+	}
+	return arguments
+}
+
+func (parser *graphqlParser) directives() []graphqlDirective {
+	var directives []graphqlDirective
+	for parser.err == nil && parser.skip("@") {
+		name := parser.name()
+		directives = append(directives, graphqlDirective{name: name, arguments: parser.arguments()})
+	}
+	return directives
+}
+
+func (parser *graphqlParser) value() interface{} {
+	if !parser.enter() {
+		return nil
+	}
+	defer func() { parser.nesting-- }()
+	switch {
+	case parser.skip("$"):
+		return graphqlVariable(parser.name())
+	case parser.skip("["):
+		list := []interface{}{}
+		for parser.err == nil && !parser.skip("]") {
+			list = append(list, parser.value())
+		}
+		return list
+	case parser.skip("{"):
+		fields := []graphqlArgument{}
+		for parser.err == nil && !parser.skip("}") {
+			name := parser.name()
+			parser.expect(":")
+			fields = append(fields, graphqlArgument{name: name, value: parser.value()})
+		}
+		return fields
+	case parser.kind == gqlName || parser.kind == gqlNumber || parser.kind == gqlString:
+		value := parser.token
+		parser.next()
+		return value
+	}
+	parser.fail("expected a value at %d", parser.pos)
+	return nil
+}
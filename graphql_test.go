@@ -0,0 +1,103 @@
+package shadowd
+
+import (
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func extractGraphQL(extractor *GraphQLExtractor, body string) (map[string]string, error) {
+	req := httptest.NewRequest("POST", "/graphql", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	inputs := make(map[string]string)
+	err := extractor.Extract(req, inputs)
+	return inputs, err
+}
+
+func TestGraphQLExtractor(t *testing.T) {
+	tests := []struct {
+		body string
+		want map[string]string
+	}{
+		{
+			`{"query":"mutation { createUser(input: {email: \"a@b\", tags: [\"x\"]}) { id } }"}`,
+			map[string]string{"GQL|createUser|input|email": "a@b", "GQL|createUser|input|tags|0": "x"},
+		},
+		{
+			`{"query":"query Q($id: ID) { user(id: $id) { id } u2: user(id: 2) { ...F } } fragment F on User { friends(first: 3) { id } }","variables":{"id":"7","extra":"x"}}`,
+			map[string]string{"GQL|user|id": "7", "GQL|user#1|id": "2", "GQL|user#1|friends|first": "3", "GQL|$extra": "x"},
+		},
+		{
+			`{"query":"{ user @include(if: true) { ... on User { name(format: \"short\") } } }"}`,
+			map[string]string{"GQL|user|@include|if": "true", "GQL|user|name|format": "short"},
+		},
+	}
+	for _, test := range tests {
+		inputs, err := extractGraphQL(&GraphQLExtractor{}, test.body)
+		if err != nil {
+			t.Errorf("%s: %v", test.body, err)
+			continue
+		}
+		if len(inputs) != len(test.want) {
+			t.Errorf("%s: got %q, want %q", test.body, inputs, test.want)
+		}
+		for key, value := range test.want {
+			if inputs[key] != value {
+				t.Errorf("%s: got %q for %s, want %q", test.body, inputs[key], key, value)
+			}
+		}
+	}
+}
+
+func TestGraphQLExtractorErrors(t *testing.T) {
+	tests := []struct {
+		query  string
+		reason string
+	}{
+		{"{ user { id }", "expected a name"},
+		{"{ }", "empty selection set"},
+		{"{ user { } }", "empty selection set"},
+		{"{ ... on User { } }", "empty selection set"},
+		{"{ ...F } fragment F on User { }", "empty selection set"},
+		{"{ ...F } fragment F on User { ...F }", "fragment cycle"},
+		{"{ ...G }", "unknown fragment"},
+		{"{ a: x b: y c: z }", "more than 2 aliases"},
+		{"{ a { b { c { d } } } }", "depth exceeds 3"},
+		{"{ a(x: " + strings.Repeat("[", GRAPHQL_MAX_NESTING) + "1" + strings.Repeat("]", GRAPHQL_MAX_NESTING) + ") }", "nested deeper"},
+	}
+	extractor := &GraphQLExtractor{MaxAliases: 2, MaxDepth: 3}
+	for _, test := range tests {
+		body := `{"query":` + strconv.Quote(test.query) + `}`
+		_, err := extractGraphQL(extractor, body)
+		var gqlErr *GraphQLError
+		if !errors.As(err, &gqlErr) || !strings.Contains(gqlErr.Reason, test.reason) {
+			t.Errorf("%s: got %v, want %q", test.query, err, test.reason)
+		}
+	}
+}
+
+// Each fragment spreads the next one twice, expanding to 2^27 fields.
+func TestGraphQLExtractorFragmentBomb(t *testing.T) {
+	var query strings.Builder
+	query.WriteString("{ ...F1 }")
+	for i := 1; i < 27; i++ {
+		next := "F" + strconv.Itoa(i+1)
+		query.WriteString(" fragment F" + strconv.Itoa(i) + " on Q { ..." + next + " ..." + next + " }")
+	}
+	query.WriteString(" fragment F27 on Q { a }")
+
+	start := time.Now()
+	req := httptest.NewRequest("GET", "/graphql?query="+url.QueryEscape(query.String()), nil)
+	err := (&GraphQLExtractor{}).Extract(req, make(map[string]string))
+	var gqlErr *GraphQLError
+	if !errors.As(err, &gqlErr) || gqlErr.Reason != "too many fields" {
+		t.Errorf("got %v, want too many fields", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("took %v to reject the document", elapsed)
+	}
+}
@@ -0,0 +1,565 @@
+package shadowd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The gRPC status codes of rejected calls.
+const (
+	GRPC_STATUS_OK                 = 0
+	GRPC_STATUS_INVALID_ARGUMENT   = 3
+	GRPC_STATUS_PERMISSION_DENIED  = 7
+	GRPC_STATUS_RESOURCE_EXHAUSTED = 8
+	GRPC_STATUS_UNAVAILABLE        = 14
+)
+
+// The MaxMessage used when it is zero, the default of the gRPC servers.
+const GRPC_DEFAULT_MAX_MESSAGE = 4 << 20
+
+// Hard limits against hostile messages.
+const (
+	PROTO_MAX_NESTING = 64
+	PROTO_MAX_INPUTS  = 10000
+)
+
+// All PROTO_X are the kinds of a ProtoField, PROTO_VARINT covers the int,
+// uint, bool and enum types.
+const (
+	PROTO_VARINT = iota
+	PROTO_SINT
+	PROTO_FIXED32
+	PROTO_FIXED64
+	PROTO_FLOAT
+	PROTO_DOUBLE
+	PROTO_STRING
+	PROTO_BYTES
+	PROTO_MESSAGE
+)
+
+var ErrProtoMalformed = errors.New("shadowd: malformed protobuf message")
+
+// A field of a protobuf message, Message names the type of PROTO_MESSAGE
+// fields.
+type ProtoField struct {
+	Name    string
+	Kind    int
+	Message string
+}
+
+// Describes protobuf messages so that their fields are sent by name, for
+// example filled from the generated descriptors of the services.
+// Messages maps the full message names to their fields by number and
+// Methods the "/package.Service/Method" paths to their request message.
+type ProtoRegistry struct {
+	Messages map[string]map[int]ProtoField
+	Methods  map[string]string
+}
+
+// Returns true if the request is a gRPC call.
+func IsGRPC(req *http.Request) bool {
+	contentType := req.Header.Get("Content-Type")
+	return strings.HasPrefix(contentType, "application/grpc") && !strings.HasPrefix(contentType, "application/grpc-web")
+}
+
+// Returns the gRPC status a call should end with for the result of a check,
+// GRPC_STATUS_PERMISSION_DENIED for attacks and GRPC_STATUS_UNAVAILABLE for
+// the verdicts of inputs shadowd could not analyse.
+func GRPCStatus(verdict *Verdict, err error) int {
+	switch {
+	case errors.Is(err, ErrProtoMalformed):
+		return GRPC_STATUS_INVALID_ARGUMENT
+	case err != nil:
+		return GRPC_STATUS_UNAVAILABLE
+	case verdict.IsAttack():
+		return GRPC_STATUS_PERMISSION_DENIED
+	case verdict.Status == STATUS_BAD_REQUEST:
+		return GRPC_STATUS_INVALID_ARGUMENT
+	case verdict.Status != STATUS_OK:
+		return GRPC_STATUS_UNAVAILABLE
+	}
+	return GRPC_STATUS_OK
+}
+
+// Sends the protobuf messages of gRPC calls as GRPC inputs keyed by their
+// field path, such as GRPC|user|email with a Registry describing the
+// request message or GRPC|1|2 with the field numbers otherwise. Without a
+// descriptor, length delimited fields are sent as text when they are
+// printable and as nested messages when they decode as one. Repeated fields
+// and the messages after the first of a stream are numbered, such as
+// GRPC|tags#1 and GRPC#1|id. The caller is the path of the call,
+// "/package.Service/Method", with the default CALLER_PATH.
+//
+// The extractor reads the whole request body, which suits unary and client
+// streaming calls. The GRPCInspector checks the messages of a stream while
+// they are proxied.
+type GRPCExtractor struct {
+	Registry   *ProtoRegistry
+	MaxMessage int
+}
+
+func (extractor *GRPCExtractor) Extract(req *http.Request, inputs map[string]string) error {
+	if !IsGRPC(req) || req.Body == nil {
+		return nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	reader := bytes.NewReader(body)
+	for i := 0; reader.Len() > 0; i++ {
+		_, message, err := extractor.readFrame(reader, req.Header.Get("Grpc-Encoding"))
+		if err != nil {
+			return err
+		}
+		if err := extractor.MessageInputs(req.URL.Path, message, grpcPrefix(i), inputs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Adds the fields of a request message of the method as inputs keyed under
+// prefix, such as "GRPC". Helps checking the messages of gRPC servers with
+// CheckInputs, for example from an interceptor.
+func (extractor *GRPCExtractor) MessageInputs(method string, message []byte, prefix string, inputs map[string]string) error {
+	decoder := &protoDecoder{inputs: inputs, seen: make(map[string]int)}
+	var messageType string
+	if extractor.Registry != nil {
+		decoder.registry = extractor.Registry
+		messageType = extractor.Registry.Methods[method]
+	}
+	return decoder.message(message, prefix, messageType, 0)
+}
+
+func grpcPrefix(i int) string {
+	if i == 0 {
+		return "GRPC"
+	}
+	return "GRPC#" + strconv.Itoa(i)
+}
+
+func (extractor *GRPCExtractor) maxMessage() int {
+	if extractor.MaxMessage > 0 {
+		return extractor.MaxMessage
+	}
+	return GRPC_DEFAULT_MAX_MESSAGE
+}
+
+var errGRPCTooLarge = errors.New("shadowd: grpc message too large")
+
+// Reads a length prefixed frame, returns it and its decompressed message.
+func (extractor *GRPCExtractor) readFrame(reader io.Reader, encoding string) ([]byte, []byte, error) {
+	frame := make([]byte, 5)
+	if _, err := io.ReadFull(reader, frame); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = ErrProtoMalformed
+		}
+		return nil, nil, err
+	}
+	length := binary.BigEndian.Uint32(frame[1:])
+	if uint64(length) > uint64(extractor.maxMessage()) {
+		return nil, nil, errGRPCTooLarge
+	}
+	frame = append(frame, make([]byte, length)...)
+	if _, err := io.ReadFull(reader, frame[5:]); err != nil {
+		return nil, nil, ErrProtoMalformed
+	}
+	message := frame[5:]
+	if frame[0] == 1 {
+		if encoding != "gzip" {
+			return nil, nil, fmt.Errorf("%w: unsupported grpc-encoding %q", ErrProtoMalformed, encoding)
+		}
+		gz, err := gzip.NewReader(bytes.NewReader(message))
+		if err != nil {
+			return nil, nil, ErrProtoMalformed
+		}
+		message, err = ioutil.ReadAll(io.LimitReader(gz, int64(extractor.maxMessage())+1))
+		if err != nil {
+			return nil, nil, ErrProtoMalformed
+		}
+		if len(message) > extractor.maxMessage() {
+			return nil, nil, errGRPCTooLarge
+		}
+	}
+	return frame, message, nil
+}
+
+// Decodes the protobuf wire format into inputs.
+type protoDecoder struct {
+	registry *ProtoRegistry
+	inputs   map[string]string
+	seen     map[string]int
+}
+
+func (decoder *protoDecoder) message(data []byte, path string, messageType string, depth int) error {
+	if depth > PROTO_MAX_NESTING {
+		return ErrProtoMalformed
+	}
+	var fields map[int]ProtoField
+	if decoder.registry != nil && messageType != "" {
+		fields = decoder.registry.Messages[messageType]
+	}
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 || tag>>3 == 0 || tag>>3 > math.MaxInt32 {
+			return ErrProtoMalformed
+		}
+		data = data[n:]
+		number := int(tag >> 3)
+		field, described := fields[number]
+		name := field.Name
+		if !described || name == "" {
+			name = strconv.Itoa(number)
+		}
+		key := decoder.key(path + "|" + escapeKey(name))
+
+		switch tag & 7 {
+		case 0:
+			value, n := binary.Uvarint(data)
+			if n <= 0 {
+				return ErrProtoMalformed
+			}
+			data = data[n:]
+			decoder.add(key, formatVarint(value, field.Kind))
+		case 1:
+			if len(data) < 8 {
+				return ErrProtoMalformed
+			}
+			decoder.add(key, formatFixed64(binary.LittleEndian.Uint64(data), field.Kind))
+			data = data[8:]
+		case 5:
+			if len(data) < 4 {
+				return ErrProtoMalformed
+			}
+			decoder.add(key, formatFixed32(binary.LittleEndian.Uint32(data), field.Kind))
+			data = data[4:]
+		case 2:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || length > uint64(len(data)-n) {
+				return ErrProtoMalformed
+			}
+			value := data[n : n+int(length)]
+			data = data[n+int(length):]
+			if err := decoder.delimited(key, value, field, described, depth); err != nil {
+				return err
+			}
+		default:
+			// groups are deprecated and not produced by proto3
+			return ErrProtoMalformed
+		}
+		if len(decoder.inputs) > PROTO_MAX_INPUTS {
+			return ErrProtoMalformed
+		}
+	}
+	return nil
+}
+
+func (decoder *protoDecoder) delimited(key string, value []byte, field ProtoField, described bool, depth int) error {
+	if !described {
+		if printable(value) {
+			decoder.add(key, string(value))
+			return nil
+		}
+		nested := &protoDecoder{inputs: make(map[string]string), seen: make(map[string]int)}
+		if nested.message(value, key, "", depth+1) == nil && len(nested.inputs) > 0 {
+			for k, v := range nested.inputs {
+				decoder.add(k, v)
+			}
+			return nil
+		}
+		decoder.add(key, string(value))
+		return nil
+	}
+
+	switch field.Kind {
+	case PROTO_STRING, PROTO_BYTES:
+		decoder.add(key, string(value))
+	case PROTO_MESSAGE:
+		return decoder.message(value, key, field.Message, depth+1)
+	default:
+		// packed repeated scalars
+		for i := 0; len(value) > 0; i++ {
+			var formatted string
+			switch field.Kind {
+			case PROTO_FIXED32, PROTO_FLOAT:
+				if len(value) < 4 {
+					return ErrProtoMalformed
+				}
+				formatted = formatFixed32(binary.LittleEndian.Uint32(value), field.Kind)
+				value = value[4:]
+			case PROTO_FIXED64, PROTO_DOUBLE:
+				if len(value) < 8 {
+					return ErrProtoMalformed
+				}
+				formatted = formatFixed64(binary.LittleEndian.Uint64(value), field.Kind)
+				value = value[8:]
+			default:
+				v, n := binary.Uvarint(value)
+				if n <= 0 {
+					return ErrProtoMalformed
+				}
+				formatted = formatVarint(v, field.Kind)
+				value = value[n:]
+			}
+			decoder.add(key+"|"+strconv.Itoa(i), formatted)
+		}
+	}
+	return nil
+}
+
+// Numbers the repeated occurrences of a key.
+func (decoder *protoDecoder) key(key string) string {
+	n := decoder.seen[key]
+	decoder.seen[key] = n + 1
+	if n > 0 {
+		return key + "#" + strconv.Itoa(n)
+	}
+	return key
+}
+
+func (decoder *protoDecoder) add(key, value string) {
+	decoder.inputs[key] = value
+}
+
+func formatVarint(value uint64, kind int) string {
+	if kind == PROTO_SINT {
+		return strconv.FormatInt(int64(value>>1)^-int64(value&1), 10)
+	}
+	return strconv.FormatInt(int64(value), 10)
+}
+
+func formatFixed32(value uint32, kind int) string {
+	if kind == PROTO_FLOAT {
+		return strconv.FormatFloat(float64(math.Float32frombits(value)), 'g', -1, 32)
+	}
+	return strconv.FormatUint(uint64(value), 10)
+}
+
+func formatFixed64(value uint64, kind int) string {
+	if kind == PROTO_DOUBLE {
+		return strconv.FormatFloat(math.Float64frombits(value), 'g', -1, 64)
+	}
+	return strconv.FormatUint(value, 10)
+}
+
+// Returns true for UTF-8 text without control characters but white space.
+func printable(data []byte) bool {
+	if !utf8.Valid(data) {
+		return false
+	}
+	for _, r := range string(data) {
+		if unicode.IsControl(r) && r != '\t' && r != '\n' && r != '\r' {
+			return false
+		}
+	}
+	return true
+}
+
+// Checks the messages of gRPC calls while they are proxied to the next
+// handler, such as an httputil.ReverseProxy to an HTTP/2 upstream. Every
+// message is held back until shadowd analysed its fields, see the
+// GRPCExtractor, with the request headers added to the first one. Calls
+// with an attack verdict end with GRPC_STATUS_PERMISSION_DENIED, with
+// GRPC_STATUS_UNAVAILABLE when shadowd could not be reached or analyse the
+// message and with GRPC_STATUS_RESOURCE_EXHAUSTED for messages above
+// MaxMessage. Other requests are passed to next.
+type GRPCInspector struct {
+	Conn      *ShadowdConn
+	Extractor *GRPCExtractor
+}
+
+// Wraps next so the messages of gRPC calls are checked.
+func (inspector *GRPCInspector) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if !IsGRPC(req) || req.Body == nil {
+			next.ServeHTTP(res, req)
+			return
+		}
+		call := &grpcCall{ResponseWriter: res}
+		body := &grpcBody{inspector: inspector, call: call, req: req, body: req.Body}
+		outreq := req.Clone(req.Context())
+		outreq.Body = body
+		defer func() {
+			if r := recover(); r != nil && (r != http.ErrAbortHandler || !call.isDenied()) {
+				panic(r)
+			}
+			call.finish()
+		}()
+		next.ServeHTTP(call, outreq)
+	})
+}
+
+func (inspector *GRPCInspector) extractor() *GRPCExtractor {
+	if inspector.Extractor != nil {
+		return inspector.Extractor
+	}
+	return &GRPCExtractor{}
+}
+
+// Returns the gRPC status for the message or GRPC_STATUS_OK to forward it.
+func (inspector *GRPCInspector) check(req *http.Request, i int, message []byte) (int, string) {
+	inputs := make(map[string]string)
+	if i == 0 {
+		inspector.Conn.headerExtractor().Extract(req, inputs)
+	}
+	err := inspector.extractor().MessageInputs(req.URL.Path, message, grpcPrefix(i), inputs)
+	if err != nil && !inspector.Conn.Observe {
+		return GRPC_STATUS_INVALID_ARGUMENT, err.Error()
+	}
+	meta := Meta{
+		ClientIP: ClientIP(req),
+		Caller:   inspector.Conn.Caller(req),
+		Resource: req.URL.Path,
+	}
+	verdict, err := inspector.Conn.CheckInputs(req.Context(), meta, inputs)
+	status := GRPCStatus(verdict, err)
+	if status == GRPC_STATUS_OK {
+		return status, ""
+	}
+	if inspector.Conn.Observe {
+		fmt.Println("Observe mode, passing a grpc call to", meta.Caller, "with status", status, err)
+		return GRPC_STATUS_OK, ""
+	}
+	if err != nil {
+		fmt.Println("Error checking the grpc call:", err)
+	}
+	if status == GRPC_STATUS_UNAVAILABLE {
+		return status, "request could not be analysed"
+	}
+	return status, "request rejected"
+}
+
+// The response of a gRPC call, ended with the status of a rejected message.
+type grpcCall struct {
+	http.ResponseWriter
+	mutex       sync.Mutex
+	wroteHeader bool
+	status      int
+	message     string
+}
+
+var errGRPCDenied = errors.New("shadowd: grpc call rejected")
+
+func (call *grpcCall) deny(status int, message string) {
+	call.mutex.Lock()
+	defer call.mutex.Unlock()
+	if call.status == GRPC_STATUS_OK {
+		call.status, call.message = status, message
+	}
+}
+
+func (call *grpcCall) isDenied() bool {
+	call.mutex.Lock()
+	defer call.mutex.Unlock()
+	return call.status != GRPC_STATUS_OK
+}
+
+func (call *grpcCall) WriteHeader(code int) {
+	call.mutex.Lock()
+	defer call.mutex.Unlock()
+	if call.status != GRPC_STATUS_OK || call.wroteHeader {
+		return
+	}
+	call.wroteHeader = true
+	call.ResponseWriter.WriteHeader(code)
+}
+
+func (call *grpcCall) Write(p []byte) (int, error) {
+	if call.isDenied() {
+		return 0, errGRPCDenied
+	}
+	call.WriteHeader(200)
+	return call.ResponseWriter.Write(p)
+}
+
+func (call *grpcCall) Unwrap() http.ResponseWriter {
+	return call.ResponseWriter
+}
+
+// Ends a rejected call, as a trailers-only response when nothing was sent.
+func (call *grpcCall) finish() {
+	call.mutex.Lock()
+	defer call.mutex.Unlock()
+	if call.status == GRPC_STATUS_OK {
+		return
+	}
+	header := call.ResponseWriter.Header()
+	if !call.wroteHeader {
+		for key := range header {
+			delete(header, key)
+		}
+		header.Set("Content-Type", "application/grpc")
+		header.Set("Grpc-Status", strconv.Itoa(call.status))
+		header.Set("Grpc-Message", call.message)
+		call.ResponseWriter.WriteHeader(200)
+		return
+	}
+	header.Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(call.status))
+	header.Set(http.TrailerPrefix+"Grpc-Message", call.message)
+}
+
+// A request body returning the frames of the client once checked.
+type grpcBody struct {
+	inspector *GRPCInspector
+	call      *grpcCall
+	req       *http.Request
+	body      io.ReadCloser
+	count     int
+	out       []byte
+	err       error
+}
+
+func (body *grpcBody) Read(p []byte) (int, error) {
+	for len(body.out) == 0 {
+		if body.err != nil {
+			return 0, body.err
+		}
+		body.err = body.readFrame()
+	}
+	n := copy(p, body.out)
+	body.out = body.out[n:]
+	return n, nil
+}
+
+func (body *grpcBody) readFrame() error {
+	extractor := body.inspector.extractor()
+	frame, message, err := extractor.readFrame(body.body, body.req.Header.Get("Grpc-Encoding"))
+	switch {
+	case err == io.EOF:
+		return io.EOF
+	case err == errGRPCTooLarge:
+		body.call.deny(GRPC_STATUS_RESOURCE_EXHAUSTED, err.Error())
+		return errGRPCDenied
+	case errors.Is(err, ErrProtoMalformed):
+		body.call.deny(GRPC_STATUS_INVALID_ARGUMENT, err.Error())
+		return errGRPCDenied
+	case err != nil:
+		return err
+	}
+	status, reason := body.inspector.check(body.req, body.count, message)
+	if status != GRPC_STATUS_OK {
+		body.call.deny(status, reason)
+		return errGRPCDenied
+	}
+	body.count++
+	body.out = frame
+	return nil
+}
+
+func (body *grpcBody) Close() error {
+	return body.body.Close()
+}
@@ -0,0 +1,235 @@
+package shadowd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// Helpers writing the protobuf wire format.
+func protoTag(number, wireType int) []byte {
+	return binary.AppendUvarint(nil, uint64(number<<3|wireType))
+}
+
+func protoVarint(number int, value uint64) []byte {
+	return binary.AppendUvarint(protoTag(number, 0), value)
+}
+
+func protoBytes(number int, value []byte) []byte {
+	data := binary.AppendUvarint(protoTag(number, 2), uint64(len(value)))
+	return append(data, value...)
+}
+
+func protoFixed64(number int, value uint64) []byte {
+	return binary.LittleEndian.AppendUint64(protoTag(number, 1), value)
+}
+
+func protoFixed32(number int, value uint32) []byte {
+	return binary.LittleEndian.AppendUint32(protoTag(number, 5), value)
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+var testRegistry = &ProtoRegistry{
+	Methods: map[string]string{"/test.Users/Create": "test.User", "/test.Trees/Walk": "test.Node"},
+	Messages: map[string]map[int]ProtoField{
+		"test.User": {
+			1: {Name: "name", Kind: PROTO_STRING},
+			2: {Name: "age", Kind: PROTO_VARINT},
+			3: {Name: "tags", Kind: PROTO_STRING},
+			4: {Name: "address", Kind: PROTO_MESSAGE, Message: "test.Address"},
+			5: {Name: "offsets", Kind: PROTO_SINT},
+			6: {Name: "ratio", Kind: PROTO_DOUBLE},
+			7: {Name: "score", Kind: PROTO_FLOAT},
+			8: {Name: "a|b", Kind: PROTO_BYTES},
+		},
+		"test.Address": {
+			1: {Name: "city", Kind: PROTO_STRING},
+		},
+		"test.Node": {
+			1: {Name: "child", Kind: PROTO_MESSAGE, Message: "test.Node"},
+		},
+	},
+}
+
+func TestProtoDecoderDescribed(t *testing.T) {
+	packed := binary.AppendUvarint(nil, 3)               // -2
+	packed = binary.AppendUvarint(packed, 4)             // 2
+	packed = binary.AppendUvarint(packed, math.MaxInt64) // a large negative
+	message := concat(
+		protoBytes(1, []byte("alice' or 1=1")),
+		protoVarint(2, 42),
+		protoBytes(3, []byte("a")),
+		protoBytes(3, []byte("b")),
+		protoBytes(4, protoBytes(1, []byte("Paris"))),
+		protoBytes(5, packed),
+		protoFixed64(6, math.Float64bits(0.5)),
+		protoFixed32(7, math.Float32bits(1.5)),
+		protoBytes(8, []byte{0, 1}),
+		protoVarint(9, 7),
+	)
+	inputs := make(map[string]string)
+	extractor := &GRPCExtractor{Registry: testRegistry}
+	if err := extractor.MessageInputs("/test.Users/Create", message, "GRPC", inputs); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"GRPC|name":         "alice' or 1=1",
+		"GRPC|age":          "42",
+		"GRPC|tags":         "a",
+		"GRPC|tags#1":       "b",
+		"GRPC|address|city": "Paris",
+		"GRPC|offsets|0":    "-2",
+		"GRPC|offsets|1":    "2",
+		"GRPC|offsets|2":    "-4611686018427387904",
+		"GRPC|ratio":        "0.5",
+		"GRPC|score":        "1.5",
+		"GRPC|a\\|b":        "\x00\x01",
+		"GRPC|9":            "7",
+	}
+	if !reflect.DeepEqual(inputs, want) {
+		t.Errorf("got  %q\nwant %q", inputs, want)
+	}
+}
+
+func TestProtoDecoderUndescribed(t *testing.T) {
+	nested := concat(protoBytes(1, []byte("x")), protoVarint(2, 150))
+	message := concat(
+		protoBytes(1, []byte("hello\tworld")),
+		protoBytes(2, nested),
+		protoBytes(3, []byte{0xff, 0x00}),
+		protoVarint(4, 1),
+	)
+	inputs := make(map[string]string)
+	if err := (&GRPCExtractor{}).MessageInputs("/unknown.Service/Call", message, "GRPC", inputs); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"GRPC|1":   "hello\tworld",
+		"GRPC|2|1": "x",
+		"GRPC|2|2": "150",
+		"GRPC|3":   "\xff\x00",
+		"GRPC|4":   "1",
+	}
+	if !reflect.DeepEqual(inputs, want) {
+		t.Errorf("got  %q\nwant %q", inputs, want)
+	}
+}
+
+func TestProtoDecoderMalformed(t *testing.T) {
+	deep := protoVarint(1, 1)
+	for i := 0; i <= PROTO_MAX_NESTING+1; i++ {
+		deep = protoBytes(1, deep)
+	}
+	tests := map[string][]byte{
+		"truncated varint":   {0x08, 0x80},
+		"truncated tag":      {0x80},
+		"field number zero":  protoVarint(0, 1),
+		"length past end":    {0x0a, 0x05, 'a'},
+		"truncated fixed64":  {0x09, 1, 2, 3},
+		"truncated fixed32":  {0x0d, 1, 2},
+		"group":              protoTag(1, 3),
+		"bad packed varints": protoBytes(5, []byte{0x80}),
+	}
+	for name, message := range tests {
+		err := (&GRPCExtractor{Registry: testRegistry}).MessageInputs("/test.Users/Create", message, "GRPC", make(map[string]string))
+		if !errors.Is(err, ErrProtoMalformed) {
+			t.Errorf("%s: got %v, want %v", name, err, ErrProtoMalformed)
+		}
+	}
+	err := (&GRPCExtractor{Registry: testRegistry}).MessageInputs("/test.Trees/Walk", deep, "GRPC", make(map[string]string))
+	if !errors.Is(err, ErrProtoMalformed) {
+		t.Errorf("too deeply nested: got %v, want %v", err, ErrProtoMalformed)
+	}
+}
+
+func grpcFrame(compressed bool, message []byte) []byte {
+	frame := make([]byte, 5, 5+len(message))
+	if compressed {
+		frame[0] = 1
+	}
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	return append(frame, message...)
+}
+
+func TestGRPCExtractor(t *testing.T) {
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(protoBytes(1, []byte("bob")))
+	w.Close()
+	body := concat(grpcFrame(false, protoBytes(1, []byte("alice"))), grpcFrame(true, gz.Bytes()))
+
+	req := httptest.NewRequest("POST", "/test.Users/Create", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/grpc+proto")
+	req.Header.Set("Grpc-Encoding", "gzip")
+	inputs := make(map[string]string)
+	if err := (&GRPCExtractor{Registry: testRegistry}).Extract(req, inputs); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"GRPC|name": "alice", "GRPC#1|name": "bob"}
+	if !reflect.DeepEqual(inputs, want) {
+		t.Errorf("got %q, want %q", inputs, want)
+	}
+
+	req = httptest.NewRequest("POST", "/test.Users/Create", bytes.NewReader(grpcFrame(false, make([]byte, 100))))
+	req.Header.Set("Content-Type", "application/grpc")
+	if err := (&GRPCExtractor{MaxMessage: 10}).Extract(req, make(map[string]string)); err != errGRPCTooLarge {
+		t.Errorf("oversized message: got %v", err)
+	}
+	req = httptest.NewRequest("POST", "/test.Users/Create", bytes.NewReader(body[:8]))
+	req.Header.Set("Content-Type", "application/grpc")
+	if err := (&GRPCExtractor{}).Extract(req, make(map[string]string)); !errors.Is(err, ErrProtoMalformed) {
+		t.Errorf("truncated frame: got %v", err)
+	}
+}
+
+func TestGRPCInspector(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		observe bool
+		status  int
+	}{
+		{"clean", "alice", false, GRPC_STATUS_OK},
+		{"attack", "<script>", false, GRPC_STATUS_PERMISSION_DENIED},
+		{"bad request", "status=2", false, GRPC_STATUS_INVALID_ARGUMENT},
+		{"bad signature", "status=3", false, GRPC_STATUS_UNAVAILABLE},
+		{"bad json", "status=4", false, GRPC_STATUS_UNAVAILABLE},
+		{"observe", "<script>", true, GRPC_STATUS_OK},
+		{"observe bad signature", "status=3", true, GRPC_STATUS_OK},
+	}
+	for _, test := range tests {
+		inspector := &GRPCInspector{
+			Conn:      &ShadowdConn{ProfileId: "1", ProfileKey: "k", Observe: test.observe, Transport: &wsTransport{&recordingTransport{}}},
+			Extractor: &GRPCExtractor{Registry: testRegistry},
+		}
+		var forwarded []byte
+		next := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			forwarded, _ = io.ReadAll(req.Body)
+			res.Write([]byte("reply"))
+		})
+		body := grpcFrame(false, protoBytes(1, []byte(test.message)))
+		req := httptest.NewRequest("POST", "/test.Users/Create", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/grpc")
+		res := httptest.NewRecorder()
+		inspector.Handler(next).ServeHTTP(res, req)
+
+		if test.status == GRPC_STATUS_OK {
+			if !bytes.Equal(forwarded, body) || res.Body.String() != "reply" {
+				t.Errorf("%s: forwarded %q and replied %q", test.name, forwarded, res.Body)
+			}
+		} else if got := res.Header().Get("Grpc-Status"); got != strconv.Itoa(test.status) || len(forwarded) != 0 {
+			t.Errorf("%s: got status %s and forwarded %q, want status %d", test.name, got, forwarded, test.status)
+		}
+	}
+}
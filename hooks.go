@@ -0,0 +1,97 @@
+package shadowd
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+// Called with the request, the inputs sent to shadowd and the verdict.
+// Hooks must not modify the inputs, for bypassed requests they are nil.
+type VerdictHook func(req *http.Request, inputs map[string]string, verdict *Verdict)
+
+// Called with the request, the inputs built so far and the error.
+type ErrorHook func(req *http.Request, inputs map[string]string, err error)
+
+// Hook kinds.
+const (
+	HOOK_VERDICT = iota
+	HOOK_ATTACK
+	HOOK_ERROR
+	HOOK_BYPASS
+)
+
+type hook struct {
+	kind      int
+	async     bool
+	onVerdict VerdictHook
+	onError   ErrorHook
+}
+
+// Registers a hook called for every verdict returned by shadowd.
+// Async hooks run in their own goroutine, the others block the check.
+// A panicking hook is recovered and logged. Hooks should be registered
+// before the connector is used.
+func (serverconn *ShadowdConn) OnVerdict(fn VerdictHook, async bool) {
+	serverconn.hooks = append(serverconn.hooks, hook{kind: HOOK_VERDICT, async: async, onVerdict: fn})
+}
+
+// Registers a hook called for STATUS_ATTACK and STATUS_CRITICAL_ATTACK verdicts.
+func (serverconn *ShadowdConn) OnAttack(fn VerdictHook, async bool) {
+	serverconn.hooks = append(serverconn.hooks, hook{kind: HOOK_ATTACK, async: async, onVerdict: fn})
+}
+
+// Registers a hook called when a check failed.
+func (serverconn *ShadowdConn) OnError(fn ErrorHook, async bool) {
+	serverconn.hooks = append(serverconn.hooks, hook{kind: HOOK_ERROR, async: async, onError: fn})
+}
+
+// Registers a hook called for requests decided without shadowd, by the
+// access list, the ban list or the Policy. The verdict Source tells which.
+func (serverconn *ShadowdConn) OnBypass(fn VerdictHook, async bool) {
+	serverconn.hooks = append(serverconn.hooks, hook{kind: HOOK_BYPASS, async: async, onVerdict: fn})
+}
+
+func (serverconn *ShadowdConn) runVerdictHooks(req *http.Request, inputs map[string]string, verdict *Verdict) {
+	for _, h := range serverconn.hooks {
+		if h.kind == HOOK_VERDICT || (h.kind == HOOK_ATTACK && verdict.IsAttack()) {
+			h.call(req, inputs, verdict, nil)
+		}
+	}
+}
+
+func (serverconn *ShadowdConn) runErrorHooks(req *http.Request, inputs map[string]string, err error) {
+	for _, h := range serverconn.hooks {
+		if h.kind == HOOK_ERROR {
+			h.call(req, inputs, nil, err)
+		}
+	}
+}
+
+func (serverconn *ShadowdConn) runBypassHooks(req *http.Request, verdict *Verdict) {
+	for _, h := range serverconn.hooks {
+		if h.kind == HOOK_BYPASS {
+			h.call(req, nil, verdict, nil)
+		}
+	}
+}
+
+func (h hook) call(req *http.Request, inputs map[string]string, verdict *Verdict, err error) {
+	run := func() {
+		defer func() {
+			if r := recover(); r != nil {
+				fmt.Printf("Recovered from a panic in a shadowd hook: %v\n%s", r, debug.Stack())
+			}
+		}()
+		if h.onError != nil {
+			h.onError(req, inputs, err)
+		} else {
+			h.onVerdict(req, inputs, verdict)
+		}
+	}
+	if h.async {
+		go run()
+	} else {
+		run()
+	}
+}
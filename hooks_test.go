@@ -0,0 +1,89 @@
+package shadowd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHooks(t *testing.T) {
+	transport := &recordingTransport{reply: `{"status":5,"threats":["GET|q"]}`}
+	serverconn := &ShadowdConn{ProfileId: "1", ProfileKey: "k", Transport: transport}
+	var called []string
+	record := func(name string) VerdictHook {
+		return func(req *http.Request, inputs map[string]string, verdict *Verdict) {
+			if inputs["GET|q"] != "1" || !verdict.IsAttack() {
+				t.Errorf("%s: called with %q and %+v", name, inputs, verdict)
+			}
+			called = append(called, name)
+		}
+	}
+	async := make(chan *Verdict, 1)
+	serverconn.OnVerdict(func(*http.Request, map[string]string, *Verdict) { panic("broken hook") }, false)
+	serverconn.OnVerdict(record("verdict"), false)
+	serverconn.OnAttack(record("attack"), false)
+	serverconn.OnVerdict(func(*http.Request, map[string]string, *Verdict) { panic("broken async hook") }, true)
+	serverconn.OnVerdict(func(req *http.Request, inputs map[string]string, verdict *Verdict) { async <- verdict }, true)
+	serverconn.OnError(func(*http.Request, map[string]string, error) { called = append(called, "error") }, false)
+	serverconn.OnBypass(record("bypass"), false)
+
+	next := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {})
+	res := httptest.NewRecorder()
+	serverconn.Middleware(next).ServeHTTP(res, httptest.NewRequest("GET", "/?q=1", nil))
+	if res.Code != 500 {
+		t.Errorf("got code %d, want the attack blocked", res.Code)
+	}
+	if len(called) != 2 || called[0] != "verdict" || called[1] != "attack" {
+		t.Errorf("hooks called %q, want verdict and attack", called)
+	}
+	select {
+	case verdict := <-async:
+		if !verdict.IsAttack() {
+			t.Errorf("async hook got %+v", verdict)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("async hook not called")
+	}
+
+	// verdicts that are not attacks skip the attack hooks
+	called = nil
+	serverconn = &ShadowdConn{ProfileId: "1", ProfileKey: "k", Transport: &recordingTransport{reply: `{"status":1}`}}
+	serverconn.OnVerdict(func(*http.Request, map[string]string, *Verdict) { called = append(called, "verdict") }, false)
+	serverconn.OnAttack(record("attack"), false)
+	serverconn.Check(httptest.NewRequest("GET", "/?q=1", nil))
+	if len(called) != 1 || called[0] != "verdict" {
+		t.Errorf("hooks called %q, want verdict only", called)
+	}
+}
+
+func TestErrorAndBypassHooks(t *testing.T) {
+	serverconn := &ShadowdConn{
+		ProfileId:  "1",
+		ProfileKey: "k",
+		Transport:  failingTransport{&recordingTransport{}},
+		Policy:     &Policy{Rules: []PolicyRule{{PathPrefix: "/static/", Action: POLICY_NEVER}}},
+	}
+	var errs []error
+	var bypassed []*Verdict
+	serverconn.OnError(func(*http.Request, map[string]string, error) { panic("broken hook") }, false)
+	serverconn.OnError(func(req *http.Request, inputs map[string]string, err error) { errs = append(errs, err) }, false)
+	serverconn.OnBypass(func(req *http.Request, inputs map[string]string, verdict *Verdict) {
+		if inputs != nil {
+			t.Errorf("bypass hook called with inputs %q", inputs)
+		}
+		bypassed = append(bypassed, verdict)
+	}, false)
+
+	handler := serverconn.Middleware(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest("GET", "/?q=1", nil))
+	if res.Code != 500 || len(errs) != 1 || len(bypassed) != 0 {
+		t.Errorf("got code %d, %d errors and %d bypasses", res.Code, len(errs), len(bypassed))
+	}
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest("GET", "/static/app.js", nil))
+	if res.Code != 200 || len(errs) != 1 || len(bypassed) != 1 || bypassed[0].Source != SOURCE_POLICY {
+		t.Errorf("got code %d, %d errors and bypasses %+v", res.Code, len(errs), bypassed)
+	}
+}
@@ -0,0 +1,80 @@
+package shadowd
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Describes the origin of inputs that do not come from an http request,
+// such as a queue consumer or a mail gateway. Caller and Resource are used
+// like the script and URI of a web request to tell the rules apart.
+type Meta struct {
+	ClientIP string
+	Caller   string
+	Resource string
+}
+
+// Sends a set of inputs that did not come from an http request to shadowd,
+// such as the fields of a queue message, and returns the verdict.
+// Input keys are "SOURCE|path" like the ones of the extractors, with the
+// path escaped by EscapeKey, such as "MESSAGE|order\/id". The inputs are
+// redacted, encoded, signed and sent like the ones of SendToShadowd and
+// the check is traced, measured, reported to the Sinks and counted by the
+// Bans when meta has a ClientIP. The hooks, which receive the request, are
+// not run. The inputs map is not modified.
+func (serverconn *ShadowdConn) CheckInputs(ctx context.Context, meta Meta, inputs map[string]string) (*Verdict, error) {
+	span, traceId := serverconn.startContextSpan(ctx)
+	event := &Event{
+		Time:     time.Now(),
+		Id:       newRequestId(),
+		ClientIP: meta.ClientIP,
+		Caller:   meta.Caller,
+		Resource: meta.Resource,
+	}
+	line, verdict, err := serverconn.checkInputs(ctx, meta, inputs, span, traceId, event)
+	if err != nil {
+		span.RecordError(err)
+		event.Error = err.Error()
+	}
+	span.End()
+	serverconn.emit(event)
+	if err != nil {
+		return nil, err
+	}
+	if verdict == nil {
+		return ParseVerdict(line)
+	}
+	return verdict, nil
+}
+
+func (serverconn *ShadowdConn) checkInputs(ctx context.Context, meta Meta, inputs map[string]string, span Span, traceId string, event *Event) (string, *Verdict, error) {
+	inputmap := make(map[string]string, len(inputs)+1)
+	for k, v := range inputs {
+		inputmap[k] = v
+	}
+	if serverconn.TraceInput && traceId != "" {
+		inputmap["SERVER|TRACE_ID"] = traceId
+	}
+	serverconn.Redactor.Redact(inputmap)
+	payload := &Payload{
+		Version:  SHADOWD_CONNECTOR_VERSION,
+		ClientIP: meta.ClientIP,
+		Caller:   meta.Caller,
+		Resource: meta.Resource,
+		Input:    inputmap,
+		Hashes:   make(map[string]string),
+	}
+	serverconn.encodeInputs("", payload)
+	event.Inputs = payload.Input
+	event.Lossy = payload.Lossy
+
+	line, verdict, err := serverconn.exchange(ctx, payload, span, event)
+	if err != nil || verdict == nil {
+		return line, nil, err
+	}
+	if meta.ClientIP != "" && serverconn.Bans.Record(meta.ClientIP, verdict) {
+		fmt.Println("Client banned after repeated attacks:", meta.ClientIP)
+	}
+	return line, verdict, nil
+}
@@ -0,0 +1,280 @@
+package shadowd
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The prefix of the ban keys returned by JWTExtractor.BanKey.
+const JWT_BAN_PREFIX = "sub:"
+
+var (
+	ErrJWTMalformed = errors.New("shadowd: malformed jwt")
+	ErrJWTAlgorithm = errors.New("shadowd: unsupported jwt algorithm")
+	ErrJWTKey       = errors.New("shadowd: no jwt key")
+	ErrJWTSignature = errors.New("shadowd: jwt signature mismatch")
+	ErrJWTExpired   = errors.New("shadowd: jwt expired")
+)
+
+// A decoded JSON Web Token.
+type JWT struct {
+	Header   map[string]interface{}
+	Claims   map[string]interface{}
+	Verified bool
+}
+
+// Returns the "sub" claim or an empty string.
+func (token *JWT) Subject() string {
+	sub, _ := token.Claims["sub"].(string)
+	return sub
+}
+
+// Decodes JSON Web Tokens from the Authorization bearer token and the named
+// Cookies and adds their header fields as JWT_HEADER|name inputs and their
+// claims as JWT|name inputs. Nested objects and arrays are flattened, such
+// as JWT|address|city or JWT|roles|0. The inputs of a token from a cookie
+// are prefixed with the cookie name, such as JWT|session|sub.
+//
+// Without a Key or Keys the tokens are decoded without verification, which
+// is enough to inspect the claims. Keys are looked up by the "kid" header
+// and fall back to Key. A []byte key verifies HS256/384/512, an
+// *rsa.PublicKey RS256/384/512 and PS256/384/512, an *ecdsa.PublicKey
+// ES256/384/512 and an ed25519.PublicKey EdDSA. Tokens failing the
+// verification are still inspected and the reason is sent as JWT|ERROR.
+type JWTExtractor struct {
+	Cookies []string
+	Key     interface{}
+	Keys    map[string]interface{}
+	// The allowed clock skew for the "exp" and "nbf" claims.
+	Leeway time.Duration
+}
+
+func (extractor *JWTExtractor) Extract(req *http.Request, inputs map[string]string) error {
+	if raw := bearerToken(req); raw != "" {
+		extractor.addInputs(raw, "", inputs)
+	}
+	for _, name := range extractor.Cookies {
+		if cookie, err := req.Cookie(name); err == nil {
+			extractor.addInputs(cookie.Value, escapeKey(name)+"|", inputs)
+		}
+	}
+	return nil
+}
+
+func (extractor *JWTExtractor) addInputs(raw string, prefix string, inputs map[string]string) {
+	token, err := extractor.Parse(raw)
+	if token == nil {
+		return
+	}
+	for name, value := range token.Header {
+		flattenJSON("JWT_HEADER|"+prefix+escapeKey(name), value, inputs)
+	}
+	for name, value := range token.Claims {
+		flattenJSON("JWT|"+prefix+escapeKey(name), value, inputs)
+	}
+	if err != nil {
+		inputs["JWT|"+prefix+"ERROR"] = err.Error()
+	}
+}
+
+// Returns the token of the Authorization header, or else of the first of
+// the Cookies holding one. With a Key or Keys only verified tokens are
+// returned.
+func (extractor *JWTExtractor) Token(req *http.Request) (*JWT, error) {
+	raw := bearerToken(req)
+	for i := 0; raw == "" && i < len(extractor.Cookies); i++ {
+		if cookie, err := req.Cookie(extractor.Cookies[i]); err == nil {
+			raw = cookie.Value
+		}
+	}
+	if raw == "" {
+		return nil, ErrJWTMalformed
+	}
+	token, err := extractor.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// Returns the ban key of the token subject, for use as ShadowdConn.BanKey.
+// Attacks are counted against the client IP as well, so requests without
+// a subject or with rotated tokens are still banned.
+// Unverified subjects are chosen by the client, configure a Key when
+// banning by subject.
+func (extractor *JWTExtractor) BanKey(req *http.Request) string {
+	token, err := extractor.Token(req)
+	if err != nil || token.Subject() == "" {
+		return ""
+	}
+	return JWT_BAN_PREFIX + token.Subject()
+}
+
+// Decodes the token and verifies it when a Key or Keys are configured.
+// The token is returned with the verification error so that the claims of
+// forged tokens can be inspected, it is nil only when malformed.
+func (extractor *JWTExtractor) Parse(raw string) (*JWT, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, ErrJWTMalformed
+	}
+	token := &JWT{}
+	if err := decodeJWTPart(parts[0], &token.Header); err != nil {
+		return nil, err
+	}
+	if err := decodeJWTPart(parts[1], &token.Claims); err != nil {
+		return nil, err
+	}
+	if extractor.Key == nil && extractor.Keys == nil {
+		return token, nil
+	}
+	key := extractor.Key
+	if kid, ok := token.Header["kid"].(string); ok && extractor.Keys[kid] != nil {
+		key = extractor.Keys[kid]
+	}
+	if key == nil {
+		return token, ErrJWTKey
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[2], "="))
+	if err != nil {
+		return token, ErrJWTMalformed
+	}
+	alg, _ := token.Header["alg"].(string)
+	if err := verifyJWT(alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return token, err
+	}
+	now := time.Now()
+	if exp, ok := token.Claims["exp"].(float64); ok && now.After(time.Unix(int64(exp), 0).Add(extractor.Leeway)) {
+		return token, ErrJWTExpired
+	}
+	if nbf, ok := token.Claims["nbf"].(float64); ok && now.Before(time.Unix(int64(nbf), 0).Add(-extractor.Leeway)) {
+		return token, ErrJWTExpired
+	}
+	token.Verified = true
+	return token, nil
+}
+
+func bearerToken(req *http.Request) string {
+	auth := req.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+func decodeJWTPart(part string, v *map[string]interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(part, "="))
+	if err != nil {
+		return ErrJWTMalformed
+	}
+	if err := json.Unmarshal(data, v); err != nil || *v == nil {
+		return ErrJWTMalformed
+	}
+	return nil
+}
+
+// Adds value as an input, objects and arrays as one input per member.
+func flattenJSON(key string, value interface{}, inputs map[string]string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for name, member := range v {
+			flattenJSON(key+"|"+escapeKey(name), member, inputs)
+		}
+	case []interface{}:
+		for i, member := range v {
+			flattenJSON(key+"|"+strconv.Itoa(i), member, inputs)
+		}
+	case string:
+		inputs[key] = v
+	case nil:
+		inputs[key] = ""
+	default:
+		data, _ := json.Marshal(v)
+		inputs[key] = string(data)
+	}
+}
+
+func verifyJWT(alg string, key interface{}, signed string, signature []byte) error {
+	var hash crypto.Hash
+	switch alg[min(2, len(alg)):] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	}
+	if alg == "EdDSA" {
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return ErrJWTKey
+		}
+		if !ed25519.Verify(pub, []byte(signed), signature) {
+			return ErrJWTSignature
+		}
+		return nil
+	}
+	if hash == 0 {
+		return ErrJWTAlgorithm
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "HS":
+		secret, ok := key.([]byte)
+		if !ok {
+			return ErrJWTKey
+		}
+		mac := hmac.New(hash.New, secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return ErrJWTSignature
+		}
+	case "RS", "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return ErrJWTKey
+		}
+		var err error
+		if alg[0] == 'R' {
+			err = rsa.VerifyPKCS1v15(pub, hash, digest, signature)
+		} else {
+			err = rsa.VerifyPSS(pub, hash, digest, signature, nil)
+		}
+		if err != nil {
+			return ErrJWTSignature
+		}
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return ErrJWTKey
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return ErrJWTSignature
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return ErrJWTSignature
+		}
+	default:
+		return ErrJWTAlgorithm
+	}
+	return nil
+}
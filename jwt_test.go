@@ -0,0 +1,160 @@
+package shadowd
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func encodeJWTPart(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func signJWT(t *testing.T, alg string, key interface{}, claims map[string]interface{}) string {
+	signed := encodeJWTPart(map[string]interface{}{"alg": alg, "typ": "JWT"}) + "." + encodeJWTPart(claims)
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	var err error
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		if alg == "PS256" {
+			signature, err = rsa.SignPSS(rand.Reader, k, crypto.SHA256, digest[:], nil)
+		} else {
+			signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		}
+	case *ecdsa.PrivateKey:
+		r, s, e := ecdsa.Sign(rand.Reader, k, digest[:])
+		signature, err = make([]byte, 64), e
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(k, []byte(signed))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerifyJWT(t *testing.T) {
+	secret := []byte("secret")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherSecret := []byte("other")
+	claims := map[string]interface{}{"sub": "alice"}
+
+	tests := []struct {
+		name   string
+		alg    string
+		sign   interface{}
+		verify interface{}
+		want   error
+	}{
+		{"HS256", "HS256", secret, secret, nil},
+		{"RS256", "RS256", rsaKey, &rsaKey.PublicKey, nil},
+		{"PS256", "PS256", rsaKey, &rsaKey.PublicKey, nil},
+		{"ES256", "ES256", ecKey, &ecKey.PublicKey, nil},
+		{"EdDSA", "EdDSA", edKey, edPub, nil},
+		{"wrong secret", "HS256", secret, otherSecret, ErrJWTSignature},
+		{"HS256 with an rsa key", "HS256", secret, &rsaKey.PublicKey, ErrJWTKey},
+		{"RS256 with a secret", "RS256", rsaKey, secret, ErrJWTKey},
+		{"RS256 with an ecdsa key", "RS256", rsaKey, &ecKey.PublicKey, ErrJWTKey},
+		{"ES256 with an rsa key", "ES256", ecKey, &rsaKey.PublicKey, ErrJWTKey},
+		{"EdDSA with a secret", "EdDSA", edKey, secret, ErrJWTKey},
+		{"none", "none", secret, secret, ErrJWTAlgorithm},
+		{"empty", "", secret, secret, ErrJWTAlgorithm},
+		{"HS", "HS", secret, secret, ErrJWTAlgorithm},
+		{"HS1", "HS1", secret, secret, ErrJWTAlgorithm},
+		{"XX256", "XX256", secret, secret, ErrJWTAlgorithm},
+	}
+	for _, test := range tests {
+		raw := signJWT(t, test.alg, test.sign, claims)
+		token, err := (&JWTExtractor{Key: test.verify}).Parse(raw)
+		if err != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+		if token == nil || token.Subject() != "alice" || token.Verified != (test.want == nil) {
+			t.Errorf("%s: unexpected token %+v", test.name, token)
+		}
+	}
+
+	// a signature of the wrong size or for other claims
+	raw := signJWT(t, "ES256", ecKey, claims)
+	if err := verifyJWT("ES256", &ecKey.PublicKey, raw, []byte{1, 2, 3}); err != ErrJWTSignature {
+		t.Errorf("short ES256 signature: got %v", err)
+	}
+	parts := strings.Split(signJWT(t, "RS256", rsaKey, claims), ".")
+	parts[1] = encodeJWTPart(map[string]interface{}{"sub": "mallory"})
+	if _, err := (&JWTExtractor{Key: &rsaKey.PublicKey}).Parse(strings.Join(parts, ".")); err != ErrJWTSignature {
+		t.Errorf("forged claims: got %v", err)
+	}
+}
+
+func TestJWTExtractor(t *testing.T) {
+	secret := []byte("secret")
+	extractor := &JWTExtractor{Key: secret, Cookies: []string{"session"}}
+
+	expired := signJWT(t, "HS256", secret, map[string]interface{}{"sub": "bob", "exp": time.Now().Add(-time.Hour).Unix()})
+	if _, err := extractor.Parse(expired); err != ErrJWTExpired {
+		t.Errorf("expired token: got %v", err)
+	}
+	if _, err := extractor.Parse("a.b"); err != ErrJWTMalformed {
+		t.Errorf("malformed token: got %v", err)
+	}
+
+	unsigned := encodeJWTPart(map[string]interface{}{"alg": "none"}) + "." +
+		encodeJWTPart(map[string]interface{}{"sub": "admin", "roles": []string{"a", "b"}}) + "."
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+unsigned)
+	inputs := make(map[string]string)
+	if err := extractor.Extract(req, inputs); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"JWT_HEADER|alg": "none",
+		"JWT|sub":        "admin",
+		"JWT|roles|0":    "a",
+		"JWT|roles|1":    "b",
+		"JWT|ERROR":      ErrJWTAlgorithm.Error(),
+	}
+	for k, v := range want {
+		if inputs[k] != v {
+			t.Errorf("input %s = %q, want %q", k, inputs[k], v)
+		}
+	}
+	if key := extractor.BanKey(req); key != "" {
+		t.Errorf("unverified subject used as ban key %q", key)
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Cookie", "session="+signJWT(t, "HS256", secret, map[string]interface{}{"sub": "carol"}))
+	if key := extractor.BanKey(req); key != JWT_BAN_PREFIX+"carol" {
+		t.Errorf("got ban key %q", key)
+	}
+}
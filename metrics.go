@@ -0,0 +1,234 @@
+package shadowd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Error classes counted by the Metrics.
+const (
+	ERROR_DIAL          = "dial"
+	ERROR_TIMEOUT       = "timeout"
+	ERROR_PROTOCOL      = "protocol"
+	ERROR_BAD_SIGNATURE = "bad_signature"
+)
+
+// The histogram buckets, latency in seconds and payload size in bytes.
+var (
+	LatencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+	PayloadBuckets = []float64{256, 1024, 4096, 16384, 65536, 262144, 1048576}
+)
+
+var statusNames = map[int]string{
+	STATUS_OK:              "ok",
+	STATUS_BAD_REQUEST:     "bad_request",
+	STATUS_BAD_SIGNATURE:   "bad_signature",
+	STATUS_BAD_JSON:        "bad_json",
+	STATUS_ATTACK:          "attack",
+	STATUS_CRITICAL_ATTACK: "critical_attack",
+}
+
+// Connector counters and histograms.
+// Metrics implements http.Handler and serves them in the Prometheus text
+// exposition format. The zero value is ready to use.
+type Metrics struct {
+	mutex    sync.Mutex
+	verdicts map[string]uint64
+	errors   map[string]uint64
+	latency  map[string]*histogram
+	payload  *histogram
+}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+// Returns an empty Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{}
+}
+
+// Creates the maps and histograms on first use, must be called with the
+// mutex held.
+func (metrics *Metrics) lazyInit() {
+	if metrics.verdicts == nil {
+		metrics.verdicts = make(map[string]uint64)
+		metrics.errors = make(map[string]uint64)
+		metrics.latency = make(map[string]*histogram)
+		metrics.payload = newHistogram(PayloadBuckets)
+	}
+}
+
+// Counts a verdict returned by shadowd, a STATUS_BAD_SIGNATURE verdict is
+// also counted as an error.
+func (metrics *Metrics) RecordVerdict(status int) {
+	if metrics == nil {
+		return
+	}
+	name, ok := statusNames[status]
+	if !ok {
+		name = strconv.Itoa(status)
+	}
+	metrics.mutex.Lock()
+	metrics.lazyInit()
+	metrics.verdicts[name]++
+	if status == STATUS_BAD_SIGNATURE {
+		metrics.errors[ERROR_BAD_SIGNATURE]++
+	}
+	metrics.mutex.Unlock()
+}
+
+// Counts an error of one of the ERROR_X classes.
+func (metrics *Metrics) RecordError(class string) {
+	if metrics == nil {
+		return
+	}
+	metrics.mutex.Lock()
+	metrics.lazyInit()
+	metrics.errors[class]++
+	metrics.mutex.Unlock()
+}
+
+// Records the round trip time to a shadowd server.
+func (metrics *Metrics) RecordLatency(server string, latency time.Duration) {
+	if metrics == nil {
+		return
+	}
+	metrics.mutex.Lock()
+	metrics.lazyInit()
+	h, ok := metrics.latency[server]
+	if !ok {
+		h = newHistogram(LatencyBuckets)
+		metrics.latency[server] = h
+	}
+	h.observe(latency.Seconds())
+	metrics.mutex.Unlock()
+}
+
+// Records the size of a payload sent to shadowd.
+func (metrics *Metrics) RecordPayload(size int) {
+	if metrics == nil {
+		return
+	}
+	metrics.mutex.Lock()
+	metrics.lazyInit()
+	metrics.payload.observe(float64(size))
+	metrics.mutex.Unlock()
+}
+
+// Writes the metrics in the Prometheus text exposition format.
+func (metrics *Metrics) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.WriteTo(res)
+}
+
+// Writes the metrics in the Prometheus text exposition format.
+func (metrics *Metrics) WriteTo(w io.Writer) (int64, error) {
+	metrics.mutex.Lock()
+	metrics.lazyInit()
+	defer metrics.mutex.Unlock()
+	cw := &countingWriter{w: w}
+
+	fmt.Fprintln(cw, "# HELP shadowd_verdicts_total Verdicts returned by shadowd by status.")
+	fmt.Fprintln(cw, "# TYPE shadowd_verdicts_total counter")
+	for _, name := range sortedKeys(metrics.verdicts) {
+		fmt.Fprintf(cw, "shadowd_verdicts_total{status=%q} %d\n", name, metrics.verdicts[name])
+	}
+	fmt.Fprintln(cw, "# HELP shadowd_errors_total Errors while checking requests by class.")
+	fmt.Fprintln(cw, "# TYPE shadowd_errors_total counter")
+	for _, class := range sortedKeys(metrics.errors) {
+		fmt.Fprintf(cw, "shadowd_errors_total{class=%q} %d\n", class, metrics.errors[class])
+	}
+	fmt.Fprintln(cw, "# HELP shadowd_request_duration_seconds Round trip time to shadowd by server.")
+	fmt.Fprintln(cw, "# TYPE shadowd_request_duration_seconds histogram")
+	servers := make([]string, 0, len(metrics.latency))
+	for server := range metrics.latency {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+	for _, server := range servers {
+		metrics.latency[server].write(cw, "shadowd_request_duration_seconds", fmt.Sprintf("server=%q,", server))
+	}
+	fmt.Fprintln(cw, "# HELP shadowd_payload_bytes Size of the payloads sent to shadowd.")
+	fmt.Fprintln(cw, "# TYPE shadowd_payload_bytes histogram")
+	metrics.payload.write(cw, "shadowd_payload_bytes", "")
+	return cw.n, cw.err
+}
+
+// Returns the ERROR_X class of an error returned while talking to shadowd.
+func errorClass(err error) string {
+	var neterr net.Error
+	if errors.As(err, &neterr) && neterr.Timeout() {
+		return ERROR_TIMEOUT
+	}
+	var operr *net.OpError
+	if errors.As(err, &operr) && operr.Op == "dial" {
+		return ERROR_DIAL
+	}
+	var dnserr *net.DNSError
+	if errors.As(err, &dnserr) {
+		return ERROR_DIAL
+	}
+	return ERROR_PROTOCOL
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(value float64) {
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name, labels string) {
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", name, labels, strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, labels, h.count)
+	if labels != "" {
+		labels = "{" + labels[:len(labels)-1] + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
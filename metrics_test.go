@@ -0,0 +1,45 @@
+package shadowd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsZeroValue(t *testing.T) {
+	var metrics Metrics
+	metrics.RecordVerdict(STATUS_ATTACK)
+	metrics.RecordVerdict(STATUS_BAD_SIGNATURE)
+	metrics.RecordError(ERROR_DIAL)
+	metrics.RecordLatency("127.0.0.1:9115", 3*time.Millisecond)
+	metrics.RecordPayload(300)
+
+	var out bytes.Buffer
+	if _, err := metrics.WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`shadowd_verdicts_total{status="attack"} 1`,
+		`shadowd_errors_total{class="bad_signature"} 1`,
+		`shadowd_errors_total{class="dial"} 1`,
+		`shadowd_request_duration_seconds_bucket{server="127.0.0.1:9115",le="0.005"} 1`,
+		`shadowd_payload_bytes_bucket{le="256"} 0`,
+		`shadowd_payload_bytes_bucket{le="1024"} 1`,
+		`shadowd_payload_bytes_count 1`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("missing %s in:\n%s", line, out.String())
+		}
+	}
+}
+
+func TestMetricsEmptyWrite(t *testing.T) {
+	var out bytes.Buffer
+	if _, err := new(Metrics).WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "shadowd_payload_bytes_count 0\n") {
+		t.Errorf("unexpected output:\n%s", out.String())
+	}
+}
@@ -0,0 +1,177 @@
+package shadowd
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// The page sent to blocked clients when ShadowdConn.BlockPage is empty.
+var DefaultBlockPage = `<!DOCTYPE html>
+<html>
+<head>
+<title>Error</title>
+<style>
+    body {
+        width: 35em;
+        margin: 0 auto;
+        font-family: Tahoma, Verdana, Arial, sans-serif;
+    }
+</style>
+</head>
+<body>
+<h1>An error occurred.</h1>
+<p>Sorry, the page you are looking for is currently unavailable.<br/>
+Please try again later.</p>
+<p>If you are the system administrator of this resource then you should check
+the error log for details.</p>
+</body>
+</html>
+`
+
+// Returns true if the request should be sent to shadowd.
+// Without a Policy every request is analysed. Skipped requests are reported
+// to the OnBypass hooks.
+func (serverconn *ShadowdConn) ShouldAnalyze(req *http.Request) bool {
+	if serverconn.Policy == nil || serverconn.Policy.ShouldAnalyze(req) {
+		return true
+	}
+	serverconn.runBypassHooks(req, &Verdict{Status: STATUS_OK, Source: SOURCE_POLICY})
+	return false
+}
+
+// Decides the request locally without contacting shadowd.
+// Returns a synthesized verdict and true when the access list allowed or
+// denied the request or the client is banned, otherwise nil and false.
+// Decided requests are reported to the OnBypass hooks.
+func (serverconn *ShadowdConn) CheckLocal(req *http.Request) (*Verdict, bool) {
+	var verdict *Verdict
+	switch serverconn.AccessList.Check(req) {
+	case ACL_ALLOW:
+		verdict = &Verdict{Status: STATUS_OK, Source: SOURCE_ACCESS_LIST}
+	case ACL_DENY:
+		verdict = &Verdict{Status: STATUS_ATTACK, Source: SOURCE_ACCESS_LIST}
+	default:
+		ip, key := ClientIP(req), serverconn.banKey(req)
+		if !serverconn.Bans.IsBanned(ip) && (key == ip || !serverconn.Bans.IsBanned(key)) {
+			return nil, false
+		}
+		verdict = &Verdict{Status: STATUS_ATTACK, Source: SOURCE_BAN_LIST}
+	}
+	serverconn.runBypassHooks(req, verdict)
+	return verdict, true
+}
+
+// Wraps an http.Handler so requests are analysed by shadowd before reaching it.
+// Requests with a STATUS_OK verdict are passed to next, any other verdict or
+// a communication error results in the BlockPage being sent to the client.
+// The access list is evaluated first and the Policy next, so denied clients
+// are blocked even when the policy would skip the analysis.
+// With a PassedKey every forwarded request carries a signed PASSED_HEADER
+// that the upstream can check with VerifyPassed.
+// The verdict is stored in the request context, see VerdictFromContext.
+func (serverconn *ShadowdConn) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if serverconn.PassedKey != "" {
+			req.Header.Del(PASSED_HEADER)
+		}
+		if verdict, ok := serverconn.CheckLocal(req); ok {
+			if serverconn.Debug {
+				fmt.Println("Request decided by the", verdict.Source, "with status", verdict.Status)
+			}
+			serverconn.serveVerdict(res, req, next, verdict)
+			return
+		}
+		if !serverconn.ShouldAnalyze(req) {
+			if serverconn.Debug {
+				fmt.Println("Request skipped by policy:", req.Method, req.URL.Path)
+			}
+			serverconn.serveVerdict(res, req, next, &Verdict{Status: STATUS_OK, Source: SOURCE_POLICY})
+			return
+		}
+		verdict, err := serverconn.Check(req)
+		var invalid *GraphQLError
+		if errors.As(err, &invalid) {
+			serverconn.serveVerdict(res, req, next, &Verdict{Status: STATUS_BAD_REQUEST, Source: SOURCE_GRAPHQL})
+			return
+		}
+		if err != nil {
+			fmt.Println("Error checking the request:", err)
+			if serverconn.Observe {
+				next.ServeHTTP(res, req)
+				return
+			}
+			serverconn.writeBlockPage(res, 500)
+			return
+		}
+		serverconn.serveVerdict(res, req, next, verdict)
+	})
+}
+
+func (serverconn *ShadowdConn) serveVerdict(res http.ResponseWriter, req *http.Request, next http.Handler, verdict *Verdict) {
+	req = req.WithContext(ContextWithVerdict(req.Context(), verdict))
+	if serverconn.Observe && verdict.Status != STATUS_OK {
+		if serverconn.Debug {
+			fmt.Println("Observe mode, passing a request with status", verdict.Status, verdict.Threats)
+		}
+		serverconn.forward(res, req, next, verdict)
+		return
+	}
+	switch verdict.Status {
+	case STATUS_OK:
+		if serverconn.Debug {
+			fmt.Println("Request reported, OK")
+		}
+		serverconn.forward(res, req, next, verdict)
+	case STATUS_BAD_REQUEST:
+		serverconn.writeBlockPage(res, 400)
+	case STATUS_ATTACK, STATUS_CRITICAL_ATTACK:
+		fmt.Println("This is an attack, needs to take action!", verdict.Threats)
+		if verdict.Source != SOURCE_SHADOWD {
+			serverconn.writeBlockPage(res, 403)
+		} else {
+			serverconn.writeBlockPage(res, 500)
+		}
+	default:
+		serverconn.writeBlockPage(res, 500)
+	}
+}
+
+func (serverconn *ShadowdConn) forward(res http.ResponseWriter, req *http.Request, next http.Handler, verdict *Verdict) {
+	if serverconn.PassedKey != "" {
+		serverconn.signPassed(req, verdict)
+	}
+	next.ServeHTTP(res, req)
+}
+
+func (serverconn *ShadowdConn) writeBlockPage(res http.ResponseWriter, code int) {
+	page := serverconn.BlockPage
+	if page == "" {
+		page = DefaultBlockPage
+	}
+	res.Header().Set("Content-Type", "text/html")
+	res.WriteHeader(code)
+	res.Write([]byte(page))
+}
+
+// Records the verdict under the client IP and the BanKey of the request, so
+// clients cannot avoid a ban by rotating or dropping their tokens.
+func (serverconn *ShadowdConn) recordBan(req *http.Request, verdict *Verdict) {
+	ip, key := ClientIP(req), serverconn.banKey(req)
+	if serverconn.Bans.Record(ip, verdict) && serverconn.Debug {
+		fmt.Println("Client banned after repeated attacks:", ip)
+	}
+	if key != ip && serverconn.Bans.Record(key, verdict) && serverconn.Debug {
+		fmt.Println("Client banned after repeated attacks:", key)
+	}
+}
+
+// Returns the BanKey of the request, or its client IP.
+func (serverconn *ShadowdConn) banKey(req *http.Request) string {
+	if serverconn.BanKey != nil {
+		if key := serverconn.BanKey(req); key != "" {
+			return key
+		}
+	}
+	return ClientIP(req)
+}
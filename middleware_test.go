@@ -0,0 +1,118 @@
+package shadowd
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// A Transport recording the payloads and failing to reach shadowd.
+type failingTransport struct {
+	*recordingTransport
+}
+
+func (transport failingTransport) Send(ctx context.Context, payload *SignedPayload) (string, error) {
+	transport.recordingTransport.Send(ctx, payload)
+	return "", errors.New("connection refused")
+}
+
+func TestMiddleware(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		reply   string // empty for a failing transport
+		setup   func(serverconn *ShadowdConn)
+		code    int
+		status  int    // of the verdict seen by next, zero when not forwarded
+		source  string // of the verdict seen by next
+		checked bool
+	}{
+		{"ok", "/", `{"status":1}`, nil, 200, STATUS_OK, SOURCE_SHADOWD, true},
+		{"attack", "/", `{"status":5,"threats":["GET|q"]}`, nil, 500, 0, "", true},
+		{"critical attack", "/", `{"status":6,"threats":["GET|q"]}`, nil, 500, 0, "", true},
+		{"bad request", "/", `{"status":2}`, nil, 400, 0, "", true},
+		{"bad signature", "/", `{"status":3}`, nil, 500, 0, "", true},
+		{"bad json", "/", `{"status":4}`, nil, 500, 0, "", true},
+		{"unreachable", "/", "", nil, 500, 0, "", true},
+		{"access list allow", "/", `{"status":5}`, func(serverconn *ShadowdConn) {
+			serverconn.AccessList = NewAccessList()
+			serverconn.AccessList.Allow("192.0.2.1")
+		}, 200, STATUS_OK, SOURCE_ACCESS_LIST, false},
+		{"access list deny", "/", `{"status":1}`, func(serverconn *ShadowdConn) {
+			serverconn.AccessList = NewAccessList()
+			serverconn.AccessList.Deny("/admin/*")
+		}, 403, 0, "", false},
+		{"ban list", "/", `{"status":1}`, func(serverconn *ShadowdConn) {
+			serverconn.Bans = &BanManager{}
+			serverconn.Bans.Add("192.0.2.1", 0)
+		}, 403, 0, "", false},
+		{"policy", "/static/app.js", `{"status":5}`, func(serverconn *ShadowdConn) {
+			serverconn.Policy = &Policy{Rules: []PolicyRule{{PathPrefix: "/static/", Action: POLICY_NEVER}}}
+		}, 200, STATUS_OK, SOURCE_POLICY, false},
+		{"invalid graphql", "/graphql?query=%7B", `{"status":1}`, func(serverconn *ShadowdConn) {
+			serverconn.GraphQL = &GraphQLExtractor{}
+		}, 400, 0, "", false},
+	}
+	for _, test := range tests {
+		for _, observe := range []bool{false, true} {
+			transport := &recordingTransport{reply: test.reply}
+			serverconn := &ShadowdConn{ProfileId: "1", ProfileKey: "k", Transport: transport, Observe: observe, BlockPage: "blocked"}
+			if test.reply == "" {
+				serverconn.Transport = failingTransport{transport}
+			}
+			if test.setup != nil {
+				test.setup(serverconn)
+			}
+			var forwarded bool
+			var verdict *Verdict
+			next := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				forwarded = true
+				verdict, _ = VerdictFromContext(req.Context())
+				res.Write([]byte("next"))
+			})
+			target := test.target
+			if target == "/" {
+				target = "/admin/x?q=1"
+			}
+			req := httptest.NewRequest("GET", target, nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+			res := httptest.NewRecorder()
+			serverconn.Middleware(next).ServeHTTP(res, req)
+
+			name := test.name
+			if observe {
+				name += " observed"
+			}
+			if test.checked != (len(transport.sent) == 1) {
+				t.Errorf("%s: sent %d payloads", name, len(transport.sent))
+			}
+			switch {
+			case test.status != 0:
+				if !forwarded || res.Code != 200 || verdict == nil || verdict.Status != test.status || verdict.Source != test.source {
+					t.Errorf("%s: got code %d and verdict %+v, want %d from %s", name, res.Code, verdict, test.status, test.source)
+				}
+			case observe:
+				// observed requests are forwarded, with their verdict when there is one
+				if !forwarded || res.Code != 200 || (test.reply != "" && verdict == nil) {
+					t.Errorf("%s: got code %d and verdict %+v, want the request forwarded", name, res.Code, verdict)
+				}
+			default:
+				if forwarded || res.Code != test.code || res.Body.String() != "blocked" {
+					t.Errorf("%s: got code %d and body %q, want %d and the block page", name, res.Code, res.Body, test.code)
+				}
+			}
+		}
+	}
+}
+
+func TestVerdictFromContext(t *testing.T) {
+	if _, ok := VerdictFromContext(context.Background()); ok {
+		t.Errorf("verdict found in an empty context")
+	}
+	verdict := &Verdict{Status: STATUS_ATTACK}
+	if got, ok := VerdictFromContext(ContextWithVerdict(context.Background(), verdict)); !ok || got != verdict {
+		t.Errorf("got %v %v", got, ok)
+	}
+}
@@ -0,0 +1,176 @@
+package shadowd
+
+import (
+	"golang.org/x/text/unicode/norm"
+	"net/http"
+	"strings"
+)
+
+// How many times a value is percent-decoded when NormalizeExtractor.MaxDecode is zero.
+const NORMALIZE_DEFAULT_DECODE = 3
+
+// Adds normalized variants of the inputs next to the raw ones, so encoding
+// evasions reach shadowd in the form the origin application interprets.
+// Values are percent-decoded repeatedly (up to MaxDecode times, mixed case
+// escapes included), overlong UTF-8 sequences are decoded, null bytes are
+// stripped and the NFKC form is applied, see NormalizeValue.
+// A "NORMALIZED|" prefixed input is added for each input that changed.
+// The raw request URI is kept as SERVER|RAW_REQUEST_URI and the normalized
+// path, with "//" and dot segments removed, as SERVER|NORMALIZED_PATH.
+type NormalizeExtractor struct {
+	MaxDecode int
+}
+
+func (extractor NormalizeExtractor) Extract(req *http.Request, inputs map[string]string) error {
+	maxDecode := extractor.MaxDecode
+	if maxDecode <= 0 {
+		maxDecode = NORMALIZE_DEFAULT_DECODE
+	}
+	normalized := make(map[string]string)
+	for k, v := range inputs {
+		if strings.HasPrefix(k, "NORMALIZED|") {
+			continue
+		}
+		if n := NormalizeValue(v, maxDecode); n != v {
+			normalized["NORMALIZED|"+k] = n
+		}
+	}
+	for k, v := range normalized {
+		inputs[k] = v
+	}
+
+	rawURI := requestURI(req)
+	rawPath := rawURI
+	if i := strings.IndexByte(rawPath, '?'); i >= 0 {
+		rawPath = rawPath[:i]
+	}
+	inputs["SERVER|RAW_REQUEST_URI"] = rawURI
+	inputs["SERVER|NORMALIZED_PATH"] = NormalizePath(rawPath, maxDecode)
+	return nil
+}
+
+// Returns the value percent-decoded up to maxDecode times, with overlong
+// UTF-8 sequences decoded, null bytes removed and the Unicode NFKC form
+// applied, so fullwidth, mathematical or circled letters become ASCII.
+func NormalizeValue(value string, maxDecode int) string {
+	for i := 0; i < maxDecode; i++ {
+		decoded := decodeOverlong(percentDecode(value))
+		if decoded == value {
+			break
+		}
+		value = decoded
+	}
+	value = strings.Replace(value, "\x00", "", -1)
+	return norm.NFKC.String(value)
+}
+
+// Returns the normalized value of a path with backslashes turned into
+// slashes, repeated slashes collapsed and dot segments removed.
+func NormalizePath(urlpath string, maxDecode int) string {
+	urlpath = NormalizeValue(urlpath, maxDecode)
+	urlpath = strings.Replace(urlpath, "\\", "/", -1)
+	for strings.Contains(urlpath, "//") {
+		urlpath = strings.Replace(urlpath, "//", "/", -1)
+	}
+	return removeDotSegments(urlpath)
+}
+
+// Matches the path of the request as decoded by net/url and its normalized
+// form. The rules letting a request through unchecked must match both, so
+// that encoded dot segments can neither escape them nor reach them from
+// another path, the others either.
+func matchRequestPath(req *http.Request, both bool, match func(string) bool) bool {
+	raw, normalized := match(req.URL.Path), match(NormalizePath(req.URL.Path, NORMALIZE_DEFAULT_DECODE))
+	if both {
+		return raw && normalized
+	}
+	return raw || normalized
+}
+
+// Decodes the valid %XX escapes of s and keeps any invalid one as is.
+func percentDecode(s string) string {
+	if strings.IndexByte(s, '%') < 0 {
+		return s
+	}
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]) {
+			b.WriteByte(unhex(s[i+1])<<4 | unhex(s[i+2]))
+			i += 2
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	}
+	return c - 'A' + 10
+}
+
+// Decodes overlong two and three byte UTF-8 encodings of ASCII characters,
+// such as "\xc0\xae" for ".", which UTF-8 decoders reject but some
+// applications still interpret.
+func decodeOverlong(s string) string {
+	var b strings.Builder
+	changed := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c == 0xc0 || c == 0xc1) && i+1 < len(s) && s[i+1]&0xc0 == 0x80 {
+			b.WriteByte((c&0x1f)<<6 | s[i+1]&0x3f)
+			i++
+			changed = true
+			continue
+		}
+		if c == 0xe0 && i+2 < len(s) && (s[i+1] == 0x80 || s[i+1] == 0x81) && s[i+2]&0xc0 == 0x80 {
+			b.WriteByte((s[i+1]&0x3f)<<6 | s[i+2]&0x3f)
+			i += 2
+			changed = true
+			continue
+		}
+		b.WriteByte(c)
+	}
+	if !changed {
+		return s
+	}
+	return b.String()
+}
+
+// Removes the "." and ".." segments of a path as described in RFC 3986 5.2.4.
+func removeDotSegments(input string) string {
+	var output []string
+	segments := strings.Split(input, "/")
+	for i, segment := range segments {
+		switch segment {
+		case ".":
+			if i == len(segments)-1 {
+				output = append(output, "")
+			}
+		case "..":
+			if len(output) > 1 {
+				output = output[:len(output)-1]
+			}
+			if i == len(segments)-1 {
+				output = append(output, "")
+			}
+		default:
+			output = append(output, segment)
+		}
+	}
+	result := strings.Join(output, "/")
+	if strings.HasPrefix(input, "/") && !strings.HasPrefix(result, "/") {
+		result = "/" + result
+	}
+	return result
+}
@@ -0,0 +1,74 @@
+package shadowd
+
+import (
+	"testing"
+)
+
+func TestNormalizeValue(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"plain", "plain"},
+		{"%252e%252e%252f", "../"},
+		{"%2E%2e%2F", "../"},
+		{"\xc0\xae\xc0\xae/", "../"},
+		{"\xe0\x80\xae\xe0\x80\xaf", "./"},
+		{"\xe0\x81\xbc", "|"},
+		{"\xe0\x82\x80", "\xe0\x82\x80"},
+		{"\xe0\x9f\xbf", "\xe0\x9f\xbf"},
+		{"a\x00b", "ab"},
+		{"＜script＞", "<script>"},
+		{"\U0001d42c\U0001d41e\U0001d425\U0001d41e\U0001d41c\U0001d42d", "select"},
+		{"ⓢⓔⓛⓔⓒⓣ", "select"},
+		{"\U0001f130\U0001f131", "AB"},
+		{"ﬁle", "file"},
+		{"1 OR 1=1", "1 OR 1=1"},
+		{"․․/", "../"},
+	}
+	for _, test := range tests {
+		if got := NormalizeValue(test.value, NORMALIZE_DEFAULT_DECODE); got != test.want {
+			t.Errorf("NormalizeValue(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestNormalizePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/static/%2e%2e/login", "/login"},
+		{"//admin/x", "/admin/x"},
+		{"/a\\..\\admin", "/admin"},
+		{"/a/./b/", "/a/b/"},
+	}
+	for _, test := range tests {
+		if got := NormalizePath(test.path, NORMALIZE_DEFAULT_DECODE); got != test.want {
+			t.Errorf("NormalizePath(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+}
+
+func TestRemoveDotSegments(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/a/b/c/./../../g", "/a/g"},
+		{"mid/content=5/../6", "mid/6"},
+		{"/a/b/..", "/a/"},
+		{"/a/b/.", "/a/b/"},
+		{"/..", "/"},
+		{"/../../x", "/x"},
+		{"/./a", "/a"},
+		{"../a", "a"},
+		{"/a/..b/c", "/a/..b/c"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := removeDotSegments(test.path); got != test.want {
+			t.Errorf("removeDotSegments(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+}
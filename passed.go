@@ -0,0 +1,154 @@
+package shadowd
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The header added to forwarded requests when ShadowdConn.PassedKey is set.
+// Its value looks like:
+//
+//	v1;status=1;src=shadowd;ts=1700000000;id=5f0c...;profile=2;sig=9a1e...
+//
+// where sig is the hex HMAC-SHA256 of everything before ";sig=".
+const PASSED_HEADER = "X-Shadowd-Passed"
+
+// How old a passed header may be before VerifyPassed rejects it.
+var PassedMaxAge = 60 * time.Second
+
+var (
+	ErrPassedKey       = errors.New("shadowd: passed header key empty")
+	ErrPassedMissing   = errors.New("shadowd: passed header missing")
+	ErrPassedMalformed = errors.New("shadowd: passed header malformed")
+	ErrPassedSignature = errors.New("shadowd: passed header signature mismatch")
+	ErrPassedExpired   = errors.New("shadowd: passed header expired")
+	ErrPassedReplayed  = errors.New("shadowd: passed header replayed")
+)
+
+// The fields of a verified passed header.
+type Passed struct {
+	Status    int
+	Source    string
+	Timestamp time.Time
+	RequestId string
+	ProfileId string
+}
+
+// Sets a signed passed header on a request that is about to be forwarded.
+// Any passed header sent by the client is replaced.
+func (serverconn *ShadowdConn) signPassed(req *http.Request, verdict *Verdict) {
+	value := fmt.Sprintf("v1;status=%d;src=%s;ts=%d;id=%s;profile=%s",
+		verdict.Status, verdict.Source, time.Now().Unix(), newRequestId(), escapePassed(serverconn.ProfileId))
+	req.Header.Set(PASSED_HEADER, value+";sig="+passedSignature(value, serverconn.PassedKey))
+}
+
+// Verifies the passed header of a request received from the connector.
+// The signature must match key, which must not be empty, the header must be younger than PassedMaxAge,
+// and the request ID must not have been seen before by this process.
+// A connector in Observe mode forwards requests with any status, so the
+// caller should check Passed.Status.
+func VerifyPassed(req *http.Request, key string) (*Passed, error) {
+	if key == "" {
+		return nil, ErrPassedKey
+	}
+	value := req.Header.Get(PASSED_HEADER)
+	if value == "" {
+		return nil, ErrPassedMissing
+	}
+	sigIndex := strings.LastIndex(value, ";sig=")
+	if sigIndex < 0 || !strings.HasPrefix(value, "v1;") {
+		return nil, ErrPassedMalformed
+	}
+	expected := passedSignature(value[:sigIndex], key)
+	if !hmac.Equal([]byte(expected), []byte(value[sigIndex+len(";sig="):])) {
+		return nil, ErrPassedSignature
+	}
+
+	passed := new(Passed)
+	for _, field := range strings.Split(value[len("v1;"):sigIndex], ";") {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return nil, ErrPassedMalformed
+		}
+		switch kv[0] {
+		case "status":
+			passed.Status, _ = strconv.Atoi(kv[1])
+		case "src":
+			passed.Source = kv[1]
+		case "ts":
+			ts, err := strconv.ParseInt(kv[1], 10, 64)
+			if err != nil {
+				return nil, ErrPassedMalformed
+			}
+			passed.Timestamp = time.Unix(ts, 0)
+		case "id":
+			passed.RequestId = kv[1]
+		case "profile":
+			passed.ProfileId = kv[1]
+		}
+	}
+	age := time.Since(passed.Timestamp)
+	if age > PassedMaxAge || age < -PassedMaxAge {
+		return nil, ErrPassedExpired
+	}
+	if !passedSeen.add(passed.RequestId, passed.Timestamp.Add(2*PassedMaxAge)) {
+		return nil, ErrPassedReplayed
+	}
+	return passed, nil
+}
+
+func passedSignature(value, key string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Keeps the header fields parsable.
+func escapePassed(value string) string {
+	return strings.NewReplacer(";", "_", "=", "_").Replace(value)
+}
+
+// Returns a random 128 bit hex identifier.
+func newRequestId() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// The request IDs seen by VerifyPassed, kept until the header would expire.
+var passedSeen = &replayCache{seen: make(map[string]time.Time)}
+
+type replayCache struct {
+	mutex sync.Mutex
+	seen  map[string]time.Time
+	purge time.Time
+}
+
+// Returns false if the id was already added and did not expire yet.
+func (cache *replayCache) add(id string, expires time.Time) bool {
+	now := time.Now()
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if now.After(cache.purge) {
+		for k, v := range cache.seen {
+			if now.After(v) {
+				delete(cache.seen, k)
+			}
+		}
+		cache.purge = now.Add(PassedMaxAge)
+	}
+	if v, ok := cache.seen[id]; ok && now.Before(v) {
+		return false
+	}
+	cache.seen[id] = expires
+	return true
+}
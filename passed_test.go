@@ -0,0 +1,41 @@
+package shadowd
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVerifyPassed(t *testing.T) {
+	serverconn := &ShadowdConn{ProfileId: "2", PassedKey: "secret"}
+	req := httptest.NewRequest("GET", "/", nil)
+	serverconn.signPassed(req, &Verdict{Status: STATUS_OK, Source: SOURCE_SHADOWD})
+
+	if _, err := VerifyPassed(req, "other"); err != ErrPassedSignature {
+		t.Errorf("wrong key: got %v, want %v", err, ErrPassedSignature)
+	}
+	if _, err := VerifyPassed(req, ""); err != ErrPassedKey {
+		t.Errorf("empty key: got %v, want %v", err, ErrPassedKey)
+	}
+	passed, err := VerifyPassed(req, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if passed.Status != STATUS_OK || passed.Source != SOURCE_SHADOWD || passed.ProfileId != "2" {
+		t.Errorf("unexpected fields %+v", passed)
+	}
+	if _, err := VerifyPassed(req, "secret"); err != ErrPassedReplayed {
+		t.Errorf("replay: got %v, want %v", err, ErrPassedReplayed)
+	}
+}
+
+func TestVerifyPassedEmptyKeyForgery(t *testing.T) {
+	value := "v1;status=1;src=shadowd;ts=0;id=forged;profile=1"
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(PASSED_HEADER, value+";sig="+passedSignature(value, ""))
+	if _, err := VerifyPassed(req, ""); err != ErrPassedKey {
+		t.Errorf("got %v, want %v", err, ErrPassedKey)
+	}
+	if _, err := VerifyPassed(httptest.NewRequest("GET", "/", nil), "secret"); err != ErrPassedMissing {
+		t.Errorf("got %v, want %v", err, ErrPassedMissing)
+	}
+}
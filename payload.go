@@ -0,0 +1,52 @@
+package shadowd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+)
+
+// The structured data sent to shadowd for analysis.
+// Input keys are "SOURCE|path" such as "GET|id" or "SERVER|HTTP_HOST" with
+// the "/" and "|" characters of the path escaped.
+// Lossy is set when an input could not be converted to UTF-8 without
+// changing it, see ShadowdConn.BinaryEncoding.
+type Payload struct {
+	Caller   string            `json:"caller"`
+	ClientIP string            `json:"client_ip"`
+	Hashes   map[string]string `json:"hashes"`
+	Input    map[string]string `json:"input"`
+	Resource string            `json:"resource"`
+	Version  string            `json:"version"`
+	Lossy    bool              `json:"-"`
+}
+
+// A payload ready to be sent, Data is the json encoded payload and
+// Signature its hex HMAC-SHA256 with the profile key.
+type SignedPayload struct {
+	ProfileId string
+	Signature string
+	Data      []byte
+}
+
+// Encodes the payload and signs it with the profile key.
+func (payload *Payload) Sign(profileId, profileKey string) (*SignedPayload, error) {
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	//mac := hmac.New(sha256.New, nil)
+	//mac.Write([]byte(unescapeKey(string(jsonData))))
+	//expectedMAC := hex.EncodeToString(mac.Sum(nil))
+	//hash["sha256"] = expectedMAC
+
+	mac := hmac.New(sha256.New, []byte(profileKey))
+	mac.Write([]byte(unescapeKey(string(jsonData))))
+	return &SignedPayload{
+		ProfileId: profileId,
+		Signature: hex.EncodeToString(mac.Sum(nil)),
+		Data:      jsonData,
+	}, nil
+}
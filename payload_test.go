@@ -0,0 +1,128 @@
+package shadowd
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// The request, data and signature sent by the connector before the
+// payload was split from the transport.
+const (
+	baselineData = `{"caller":"/a/b.php","client_ip":"10.0.0.1","hashes":{},"input":{"COOKIE|s":"abc","COOKIE|t":"d",` +
+		`"DATA|raw":"body=1","POST|p\\|q":"2","POST|x":"1","POST|y\\/z":"'","SERVER|HTTP_COOKIE":"s=abc; t=d",` +
+		`"SERVER|HTTP_HOST":"example.com","SERVER|HTTP_PORT":"8080","SERVER|HTTP_REMOTEADDR":"10.0.0.1:5555",` +
+		`"SERVER|HTTP_USER_AGENT":"ua"},"resource":"/a/b.php","version":"2.0.1-go"}`
+	baselineSignature = "dc7678d33ca04a5fe502f2f102443ebab1532bd81374bb59809de836c5860ef6"
+)
+
+func baselineRequest() (*http.Request, *ShadowdConn) {
+	req, _ := http.NewRequest("POST", "http://example.com:8080/a/b.php?x=1&y/z=%27&p|q=2", strings.NewReader("body=1"))
+	req.RemoteAddr = "10.0.0.1:5555"
+	req.Header.Set("Cookie", "s=abc; t=d")
+	req.Header.Set("User-Agent", "ua")
+	return req, &ShadowdConn{ProfileId: "2", ProfileKey: "k", ReadBody: true, LogFullCookie: true}
+}
+
+func TestPayloadSign(t *testing.T) {
+	payload := &Payload{
+		Caller:   "/a/b.php",
+		ClientIP: "10.0.0.1",
+		Hashes:   map[string]string{},
+		Input: map[string]string{
+			"COOKIE|s": "abc", "COOKIE|t": "d", "DATA|raw": "body=1",
+			"POST|p\\|q": "2", "POST|x": "1", "POST|y\\/z": "'",
+			"SERVER|HTTP_COOKIE": "s=abc; t=d", "SERVER|HTTP_HOST": "example.com",
+			"SERVER|HTTP_PORT": "8080", "SERVER|HTTP_REMOTEADDR": "10.0.0.1:5555",
+			"SERVER|HTTP_USER_AGENT": "ua",
+		},
+		Resource: "/a/b.php",
+		Version:  SHADOWD_CONNECTOR_VERSION,
+	}
+	signed, err := payload.Sign("2", "k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(signed.Data) != baselineData {
+		t.Errorf("data\ngot  %s\nwant %s", signed.Data, baselineData)
+	}
+	if signed.Signature != baselineSignature || signed.ProfileId != "2" {
+		t.Errorf("got profile %s signature %s, want 2 %s", signed.ProfileId, signed.Signature, baselineSignature)
+	}
+
+	// the signature covers the unescaped keys
+	other, _ := payload.Sign("2", "other")
+	if other.Signature == baselineSignature {
+		t.Errorf("signature does not depend on the key")
+	}
+}
+
+type recordingTransport struct {
+	sent  []*SignedPayload
+	reply string
+}
+
+func (transport *recordingTransport) Send(ctx context.Context, payload *SignedPayload) (string, error) {
+	transport.sent = append(transport.sent, payload)
+	return transport.reply, nil
+}
+
+func TestCheckTransport(t *testing.T) {
+	req, serverconn := baselineRequest()
+	transport := &recordingTransport{reply: `{"status":5,"threats":["POST|x"]}` + "\n"}
+	serverconn.Transport = transport
+	verdict, err := serverconn.Check(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verdict.IsAttack() || len(verdict.Threats) != 1 || verdict.Threats[0] != "POST|x" {
+		t.Errorf("unexpected verdict %+v", verdict)
+	}
+	if len(transport.sent) != 1 || string(transport.sent[0].Data) != baselineData {
+		t.Errorf("unexpected payloads %v", transport.sent)
+	}
+}
+
+func TestTCPTransportWire(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		var lines []string
+		for i := 0; i < 3; i++ {
+			line, _ := reader.ReadString('\n')
+			lines = append(lines, line)
+		}
+		conn.Write([]byte("{\"status\":1}\n"))
+		received <- lines
+	}()
+
+	req, serverconn := baselineRequest()
+	serverconn.ServerAddr = listener.Addr().String()
+	res, err := serverconn.SendToShadowd(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != "{\"status\":1}\n" {
+		t.Errorf("got reply %q", res)
+	}
+	lines := <-received
+	want := []string{"2\n", baselineSignature + "\n", baselineData + "\n"}
+	for i := range want {
+		if lines[i] != want[i] {
+			t.Errorf("line %d\ngot  %q\nwant %q", i, lines[i], want[i])
+		}
+	}
+}
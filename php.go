@@ -0,0 +1,199 @@
+package shadowd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Returns the extractors reproducing the inputs of the PHP connector, used
+// by DefaultExtractors in PHPCompat mode. Query arguments are GET inputs
+// whatever the method, form bodies are POST inputs, array arguments such
+// as "a[b][]" become "a|b|0" and the $_SERVER variables of a typical
+// PHP-FPM setup are SERVER inputs. Like PHP, "a[][b]" becomes "a|0|b",
+// "a|1|b" for its next value and so on.
+func (serverconn *ShadowdConn) PHPExtractors() []InputExtractor {
+	extractors := []InputExtractor{
+		PHPQueryExtractor{},
+		CookieExtractor{Upper: serverconn.UpperCookies, Full: serverconn.LogFullCookie},
+		serverconn.headerExtractor(),
+		PHPServerExtractor{DocumentRoot: serverconn.DocumentRoot},
+	}
+	if serverconn.ReadBody {
+		extractors = append(extractors, &PHPFormExtractor{})
+	}
+	return extractors
+}
+
+// Adds the SERVER inputs the PHP connector sends from $_SERVER.
+// DocumentRoot is prefixed to the script name for SCRIPT_FILENAME.
+// It runs after the HeaderExtractor since PHP has the Host header as
+// HTTP_HOST and the content headers without the HTTP_ prefix.
+type PHPServerExtractor struct {
+	DocumentRoot string
+}
+
+func (extractor PHPServerExtractor) Extract(req *http.Request, inputs map[string]string) error {
+	scriptName := phpScriptName(req.URL.Path)
+	inputs["SERVER|REQUEST_URI"] = requestURI(req)
+	inputs["SERVER|QUERY_STRING"] = req.URL.RawQuery
+	inputs["SERVER|REQUEST_METHOD"] = req.Method
+	inputs["SERVER|SCRIPT_NAME"] = scriptName
+	inputs["SERVER|SCRIPT_FILENAME"] = path.Join(extractor.DocumentRoot, scriptName)
+	inputs["SERVER|PHP_SELF"] = req.URL.Path
+	inputs["SERVER|DOCUMENT_ROOT"] = extractor.DocumentRoot
+	inputs["SERVER|SERVER_PROTOCOL"] = req.Proto
+	host, port, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host = req.Host
+		port = "80"
+		if req.TLS != nil {
+			port = "443"
+		}
+	}
+	inputs["SERVER|SERVER_NAME"] = host
+	inputs["SERVER|SERVER_PORT"] = port
+	if req.TLS != nil {
+		inputs["SERVER|HTTPS"] = "on"
+	}
+	remoteHost, remotePort, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		remoteHost = ClientIP(req)
+	}
+	inputs["SERVER|REMOTE_ADDR"] = remoteHost
+	if remotePort != "" {
+		inputs["SERVER|REMOTE_PORT"] = remotePort
+	}
+	inputs["SERVER|HTTP_HOST"] = req.Host
+	delete(inputs, "SERVER|HTTP_CONTENT_TYPE")
+	delete(inputs, "SERVER|HTTP_CONTENT_LENGTH")
+	if value := req.Header.Get("Content-Type"); value != "" {
+		inputs["SERVER|CONTENT_TYPE"] = value
+	}
+	if req.ContentLength > 0 {
+		inputs["SERVER|CONTENT_LENGTH"] = strconv.FormatInt(req.ContentLength, 10)
+	}
+	return nil
+}
+
+// Adds the query arguments as GET inputs using the PHP array notation.
+type PHPQueryExtractor struct{}
+
+func (PHPQueryExtractor) Extract(req *http.Request, inputs map[string]string) error {
+	addPHPValues("GET", req.URL.Query(), inputs)
+	return nil
+}
+
+// Adds url encoded and multipart form bodies as POST inputs using the PHP
+// array notation and any other body as the DATA|raw input.
+// The body is replaced with a readable copy for the next handlers.
+type PHPFormExtractor struct{}
+
+func (*PHPFormExtractor) Extract(req *http.Request, inputs map[string]string) error {
+	if req.Body == nil || req.Method == "GET" || req.Method == "HEAD" {
+		return nil
+	}
+	contents, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(contents))
+
+	mediatype, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	switch mediatype {
+	case "application/x-www-form-urlencoded":
+		values, err := url.ParseQuery(string(contents))
+		if err == nil {
+			addPHPValues("POST", values, inputs)
+			return nil
+		}
+	case "multipart/form-data":
+		form := &http.Request{
+			Method: "POST",
+			Header: http.Header{"Content-Type": {req.Header.Get("Content-Type")}},
+			Body:   ioutil.NopCloser(bytes.NewReader(contents)),
+		}
+		if err := form.ParseMultipartForm(32 << 20); err == nil {
+			addPHPValues("POST", form.MultipartForm.Value, inputs)
+			indexes := make(map[string]int)
+			for name, files := range form.MultipartForm.File {
+				for i, file := range files {
+					key := phpKey(name, indexes)
+					if len(files) > 1 && !strings.Contains(name, "[]") {
+						key += "|" + strconv.Itoa(i)
+					}
+					inputs["FILES|"+key] = file.Filename
+				}
+			}
+			form.MultipartForm.RemoveAll()
+			return nil
+		}
+	}
+	inputs["DATA|raw"] = string(contents)
+	return nil
+}
+
+func addPHPValues(source string, values url.Values, inputs map[string]string) {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	indexes := make(map[string]int)
+	for _, name := range names {
+		list := values[name]
+		if strings.Contains(name, "[]") {
+			for _, value := range list {
+				inputs[source+"|"+phpKey(name, indexes)] = value
+			}
+			continue
+		}
+		// PHP keeps the last value of a repeated argument
+		inputs[source+"|"+phpKey(name, nil)] = list[len(list)-1]
+	}
+}
+
+// Converts a PHP argument name such as "a[][b]" to the escaped input path
+// "a|0|b". Every empty index takes the next index of its array, counted in
+// indexes like PHP does for the arguments of a request, or 0 when indexes
+// is nil.
+func phpKey(name string, indexes map[string]int) string {
+	open := strings.IndexByte(name, '[')
+	if open <= 0 || !strings.HasSuffix(name, "]") {
+		return escapeKey(name)
+	}
+	key := escapeKey(name[:open])
+	for _, part := range strings.Split(name[open+1:len(name)-1], "][") {
+		if part == "" {
+			index := indexes[key]
+			if indexes != nil {
+				indexes[key] = index + 1
+			}
+			part = strconv.Itoa(index)
+		} else {
+			part = escapeKey(part)
+		}
+		key += "|" + part
+	}
+	return key
+}
+
+// Returns the part of the path up to the executed php script, such as
+// "/app/index.php" for "/app/index.php/users/1", or the path itself.
+func phpScriptName(urlpath string) string {
+	if i := strings.Index(urlpath, ".php/"); i >= 0 {
+		return urlpath[:i+len(".php")]
+	}
+	return urlpath
+}
+
+func (serverconn *ShadowdConn) phpScriptFilename(req *http.Request) string {
+	return path.Join(serverconn.DocumentRoot, phpScriptName(req.URL.Path))
+}
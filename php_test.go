@@ -0,0 +1,94 @@
+package shadowd
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPHPKey(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"a", "a"},
+		{"a[]", "a|0"},
+		{"a[b]", "a|b"},
+		{"a[b][]", "a|b|0"},
+		{"a[b][c]", "a|b|c"},
+		{"a[][b]", "a|0|b"},
+		{"[x]", "[x]"},
+		{"a[b", "a[b"},
+		{"a/b[c|d]", "a\\/b|c\\|d"},
+	}
+	for _, test := range tests {
+		if got := phpKey(test.name, nil); got != test.want {
+			t.Errorf("phpKey(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestAddPHPValues(t *testing.T) {
+	values, _ := url.ParseQuery("a[][b]=1&a[][b]=2&a[][c]=3&x=1&x=2&t[]=p&t[]=q&m[k][]=v")
+	inputs := make(map[string]string)
+	addPHPValues("GET", values, inputs)
+	want := map[string]string{
+		"GET|a|0|b": "1", "GET|a|1|b": "2", "GET|a|2|c": "3",
+		"GET|x": "2", "GET|t|0": "p", "GET|t|1": "q", "GET|m|k|0": "v",
+	}
+	if !reflect.DeepEqual(inputs, want) {
+		t.Errorf("got %q, want %q", inputs, want)
+	}
+}
+
+func TestPHPCompatPayload(t *testing.T) {
+	req, serverconn := baselineRequest()
+	req.RequestURI = "/app/index.php/users/1?id=5&f[]=a"
+	req.URL, _ = url.Parse("http://example.com:8080/app/index.php/users/1?id=5&f[]=a")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.ContentLength = 6
+	serverconn.PHPCompat = true
+	serverconn.DocumentRoot = "/var/www"
+	payload, err := serverconn.BuildPayload(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload.Caller != "/var/www/app/index.php" || payload.Resource != "/app/index.php/users/1?id=5&f[]=a" {
+		t.Errorf("got caller %q and resource %q", payload.Caller, payload.Resource)
+	}
+	want := map[string]string{
+		"GET|id":                 "5",
+		"GET|f|0":                "a",
+		"POST|body":              "1",
+		"SERVER|REQUEST_URI":     "/app/index.php/users/1?id=5&f[]=a",
+		"SERVER|QUERY_STRING":    "id=5&f[]=a",
+		"SERVER|REQUEST_METHOD":  "POST",
+		"SERVER|SCRIPT_NAME":     "/app/index.php",
+		"SERVER|SCRIPT_FILENAME": "/var/www/app/index.php",
+		"SERVER|PHP_SELF":        "/app/index.php/users/1",
+		"SERVER|DOCUMENT_ROOT":   "/var/www",
+		"SERVER|SERVER_NAME":     "example.com",
+		"SERVER|SERVER_PORT":     "8080",
+		"SERVER|REMOTE_ADDR":     "10.0.0.1",
+		"SERVER|REMOTE_PORT":     "5555",
+		"SERVER|HTTP_HOST":       "example.com:8080",
+		"SERVER|CONTENT_TYPE":    "application/x-www-form-urlencoded",
+		"SERVER|CONTENT_LENGTH":  "6",
+	}
+	for key, value := range want {
+		if payload.Input[key] != value {
+			t.Errorf("got %q for %s, want %q", payload.Input[key], key, value)
+		}
+	}
+	for key := range payload.Input {
+		if strings.HasPrefix(key, "POST|") && key != "POST|body" || key == "SERVER|HTTP_CONTENT_TYPE" || key == "DATA|raw" {
+			t.Errorf("unexpected input %s", key)
+		}
+	}
+
+	serverconn.CallerStrategy = CALLER_HOST_PATH
+	if caller := serverconn.Caller(req); caller != "example.com:8080/app/index.php/users/1" {
+		t.Errorf("got host path caller %q", caller)
+	}
+}
@@ -0,0 +1,130 @@
+package shadowd
+
+import (
+	"math/rand"
+	"mime"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Policy actions, describing whether a matched request should be analysed.
+const (
+	POLICY_ALWAYS = 1
+	POLICY_NEVER  = 2
+	POLICY_SAMPLE = 3
+)
+
+// A single policy rule.
+// Every non empty match field must match the request for the rule to apply.
+// PathPrefix, PathGlob and Extensions match the path as decoded by net/url
+// and its normalized form, with its escapes decoded and its dot segments and
+// repeated slashes removed, see NormalizePath. POLICY_ALWAYS rules apply
+// when either form matches, the rules that may skip the analysis only when
+// both do, so neither "/static/%2e%2e/login" nor "/api/%252e%252e/static/x"
+// matches "/static/".
+// Hosts may contain a leading wildcard such as "*.example.com",
+// Extensions are compared including the dot (".css") and ContentTypes are
+// compared against the media type of the request Content-Type header.
+// SampleRate is a percentage (0-100) used by the POLICY_SAMPLE action.
+type PolicyRule struct {
+	Methods      []string
+	PathPrefix   string
+	PathGlob     string
+	Hosts        []string
+	Extensions   []string
+	ContentTypes []string
+	Action       int
+	SampleRate   float64
+}
+
+// An ordered list of rules deciding per request whether it is sent to shadowd.
+// The first matching rule wins, when no rule matches the DefaultAction is used.
+// A zero DefaultAction means POLICY_ALWAYS.
+type Policy struct {
+	Rules             []PolicyRule
+	DefaultAction     int
+	DefaultSampleRate float64
+}
+
+// Returns true if all of the rule match fields match the request.
+func (rule *PolicyRule) Matches(req *http.Request) bool {
+	if len(rule.Methods) > 0 && !containsFold(rule.Methods, req.Method) {
+		return false
+	}
+	skip := rule.Action == POLICY_NEVER || rule.Action == POLICY_SAMPLE
+	if !matchRequestPath(req, skip, rule.matchesPath) {
+		return false
+	}
+	if len(rule.Hosts) > 0 && !matchHost(rule.Hosts, req.Host) {
+		return false
+	}
+	if len(rule.ContentTypes) > 0 {
+		mediatype, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if err != nil || !containsFold(rule.ContentTypes, mediatype) {
+			return false
+		}
+	}
+	return true
+}
+
+func (rule *PolicyRule) matchesPath(urlpath string) bool {
+	if rule.PathPrefix != "" && !strings.HasPrefix(urlpath, rule.PathPrefix) {
+		return false
+	}
+	if rule.PathGlob != "" {
+		matched, err := path.Match(rule.PathGlob, urlpath)
+		if err != nil || !matched {
+			return false
+		}
+	}
+	return len(rule.Extensions) == 0 || containsFold(rule.Extensions, path.Ext(urlpath))
+}
+
+// Returns true if the request should be sent to shadowd for analysis.
+func (policy *Policy) ShouldAnalyze(req *http.Request) bool {
+	for i := range policy.Rules {
+		if policy.Rules[i].Matches(req) {
+			return decideAction(policy.Rules[i].Action, policy.Rules[i].SampleRate)
+		}
+	}
+	return decideAction(policy.DefaultAction, policy.DefaultSampleRate)
+}
+
+func decideAction(action int, rate float64) bool {
+	switch action {
+	case POLICY_NEVER:
+		return false
+	case POLICY_SAMPLE:
+		return rand.Float64()*100 < rate
+	default:
+		return true
+	}
+}
+
+func containsFold(list []string, value string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchHost(hosts []string, hostport string) bool {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	for _, h := range hosts {
+		if strings.HasPrefix(h, "*.") {
+			if strings.HasSuffix(strings.ToLower(host), strings.ToLower(h[1:])) {
+				return true
+			}
+		} else if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
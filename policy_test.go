@@ -0,0 +1,64 @@
+package shadowd
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPolicyRuleMatchesNormalizedPath(t *testing.T) {
+	policy := &Policy{Rules: []PolicyRule{
+		{PathPrefix: "/static/", Action: POLICY_NEVER},
+		{Extensions: []string{".css"}, Action: POLICY_NEVER},
+	}}
+	tests := []struct {
+		target  string
+		analyze bool
+	}{
+		{"/static/app.js", false},
+		{"/static/%2e%2e/login", true},
+		{"/static/%252e%252e/login", true},
+		{"/static/..%5clogin", true},
+		{"/static/../login", true},
+		{"/login", true},
+		{"/theme.css", false},
+		{"/theme.css/%2e%2e/login", true},
+		{"//static/app.js", true},
+		{"/api/%252e%252e/static/x?id=<script>", true},
+		{"/api/%2e%2e/static/x", true},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "http://example.com"+test.target, nil)
+		if got := policy.ShouldAnalyze(req); got != test.analyze {
+			t.Errorf("ShouldAnalyze(%s) = %v, want %v", test.target, got, test.analyze)
+		}
+	}
+}
+
+func TestPolicyRuleAlwaysMatchesEitherPath(t *testing.T) {
+	policy := &Policy{
+		Rules:         []PolicyRule{{PathPrefix: "/admin/", Action: POLICY_ALWAYS}},
+		DefaultAction: POLICY_NEVER,
+	}
+	for _, target := range []string{"/admin/users", "/static/%2e%2e/admin/users", "/admin/%2e%2e/static/x"} {
+		req := httptest.NewRequest("GET", "http://example.com"+target, nil)
+		if !policy.ShouldAnalyze(req) {
+			t.Errorf("ShouldAnalyze(%s) = false, want true", target)
+		}
+	}
+}
+
+func TestPolicyRuleGlob(t *testing.T) {
+	rule := &PolicyRule{PathGlob: "/img/*.png", Methods: []string{"GET"}}
+	req := httptest.NewRequest("GET", "/img/a.png", nil)
+	if !rule.Matches(req) {
+		t.Errorf("expected /img/a.png to match")
+	}
+	req = httptest.NewRequest("GET", "/img/%2e%2e/admin.png", nil)
+	if rule.Matches(req) {
+		t.Errorf("expected /img/%%2e%%2e/admin.png not to match")
+	}
+	req = httptest.NewRequest("POST", "/img/a.png", nil)
+	if rule.Matches(req) {
+		t.Errorf("expected POST not to match")
+	}
+}
@@ -0,0 +1,246 @@
+package shadowd
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// All REDACT_X are the actions of a RedactRule.
+const (
+	REDACT_DROP     = 1
+	REDACT_HASH     = 2
+	REDACT_TRUNCATE = 3
+)
+
+// The length REDACT_TRUNCATE keeps when the rule has none.
+const REDACT_DEFAULT_LENGTH = 16
+
+// The prefix of values replaced by REDACT_HASH.
+const REDACT_HASH_PREFIX = "hmac:"
+
+// Redacts the inputs whose key equals Key or matches it as a glob, such as
+// "SERVER|HTTP_AUTHORIZATION" or "COOKIE|*", or which match Regexp.
+// The "NORMALIZED|" copies of the inputs, see NormalizeExtractor, match
+// the rules of the inputs they are copied from.
+// Length is the number of characters REDACT_TRUNCATE keeps.
+type RedactRule struct {
+	Key    string
+	Regexp *regexp.Regexp
+	Action int
+	Length int
+}
+
+// Returns true if the rule applies to the input key.
+func (rule RedactRule) Matches(key string) bool {
+	if normalized := strings.TrimPrefix(key, "NORMALIZED|"); normalized != key && rule.Matches(normalized) {
+		return true
+	}
+	if rule.Key != "" {
+		if rule.Key == key {
+			return true
+		}
+		if matched, _ := path.Match(rule.Key, key); matched {
+			return true
+		}
+	}
+	return rule.Regexp != nil && rule.Regexp.MatchString(key)
+}
+
+// Applies the first matching RedactRule to every input.
+// Hashed values are replaced with REDACT_HASH_PREFIX and the hex
+// HMAC-SHA256 of the value keyed with HashKey, so that equal values still
+// compare equal while the value itself never leaves the host. Without a
+// HashKey a random key is used, which keeps equality only until restart.
+// As an InputExtractor it redacts the inputs of the extractors before it,
+// see RedactRequest.
+type Redactor struct {
+	Rules   []RedactRule
+	HashKey string
+
+	once      sync.Once
+	randomKey []byte
+}
+
+// The inputs holding the request URI or its query string.
+var redactURIInputs = []string{"SERVER|RAW_REQUEST_URI", "SERVER|REQUEST_URI", "SERVER|QUERY_STRING"}
+
+func (redactor *Redactor) Extract(req *http.Request, inputs map[string]string) error {
+	redactor.RedactRequest(req, inputs)
+	return nil
+}
+
+// Redacts the inputs in place. A nil Redactor changes nothing.
+func (redactor *Redactor) Redact(inputs map[string]string) {
+	if redactor == nil {
+		return
+	}
+	for key, value := range inputs {
+		if rule := redactor.rule(key); rule != nil {
+			if value, ok := redactor.apply(rule, value); ok {
+				inputs[key] = value
+			} else {
+				delete(inputs, key)
+			}
+		}
+	}
+}
+
+// Redacts the inputs in place, then the query arguments of req within the
+// request URI and query string inputs, see RedactURI. Their "NORMALIZED|"
+// copies are normalized again from the redacted values.
+func (redactor *Redactor) RedactRequest(req *http.Request, inputs map[string]string) {
+	if redactor == nil {
+		return
+	}
+	redactor.Redact(inputs)
+	for _, key := range redactURIInputs {
+		value, ok := inputs[key]
+		if !ok {
+			continue
+		}
+		var redacted string
+		if key == "SERVER|QUERY_STRING" {
+			redacted = redactor.redactQuery(req.Method, value)
+		} else {
+			redacted = redactor.RedactURI(req.Method, value)
+		}
+		if redacted == value {
+			continue
+		}
+		inputs[key] = redacted
+		if _, ok := inputs["NORMALIZED|"+key]; ok {
+			delete(inputs, "NORMALIZED|"+key)
+			if normalized := NormalizeValue(redacted, NORMALIZE_DEFAULT_DECODE); normalized != redacted {
+				inputs["NORMALIZED|"+key] = normalized
+			}
+		}
+	}
+}
+
+// Redacts the query arguments of a request URI sent with method, such as
+// "/login?token=...", whose inputs the rules match. The arguments are keyed
+// both like the QueryExtractor and the PHPQueryExtractor key them.
+// A nil Redactor changes nothing.
+func (redactor *Redactor) RedactURI(method, uri string) string {
+	urlpath, query, found := strings.Cut(uri, "?")
+	if redactor == nil || !found {
+		return uri
+	}
+	return urlpath + "?" + redactor.redactQuery(method, query)
+}
+
+func (redactor *Redactor) redactQuery(method, query string) string {
+	parts := strings.Split(query, "&")
+	kept := parts[:0]
+	changed := false
+	indexes := make(map[string]int)
+	for _, part := range parts {
+		rawName, rawValue, _ := strings.Cut(part, "=")
+		name, err := url.QueryUnescape(rawName)
+		if err != nil {
+			name = rawName
+		}
+		rule := redactor.rule(method+"|"+escapeKey(name), "GET|"+phpKey(name, indexes))
+		if rule == nil {
+			kept = append(kept, part)
+			continue
+		}
+		changed = true
+		value, err := url.QueryUnescape(rawValue)
+		if err != nil {
+			value = rawValue
+		}
+		if value, ok := redactor.apply(rule, value); ok {
+			kept = append(kept, rawName+"="+url.QueryEscape(value))
+		}
+	}
+	if !changed {
+		return query
+	}
+	return strings.Join(kept, "&")
+}
+
+// Returns the first rule matching one of the keys or nil.
+func (redactor *Redactor) rule(keys ...string) *RedactRule {
+	for i := range redactor.Rules {
+		for _, key := range keys {
+			if redactor.Rules[i].Matches(key) {
+				return &redactor.Rules[i]
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the redacted value, or false when the rule drops it.
+func (redactor *Redactor) apply(rule *RedactRule, value string) (string, bool) {
+	switch rule.Action {
+	case REDACT_DROP:
+		return "", false
+	case REDACT_HASH:
+		return redactor.Hash(value), true
+	case REDACT_TRUNCATE:
+		return truncate(value, rule.Length), true
+	}
+	return value, true
+}
+
+// Returns the redacted form of a REDACT_HASH value.
+func (redactor *Redactor) Hash(value string) string {
+	key := []byte(redactor.HashKey)
+	if len(key) == 0 {
+		redactor.once.Do(func() {
+			redactor.randomKey = make([]byte, 32)
+			rand.Read(redactor.randomKey)
+		})
+		key = redactor.randomKey
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return REDACT_HASH_PREFIX + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Truncates to length characters, or bytes when value is not UTF-8.
+func truncate(value string, length int) string {
+	if length <= 0 {
+		length = REDACT_DEFAULT_LENGTH
+	}
+	if !utf8.ValidString(value) {
+		if len(value) > length {
+			return value[:length]
+		}
+		return value
+	}
+	for i := range value {
+		if length == 0 {
+			return value[:i]
+		}
+		length--
+	}
+	return value
+}
+
+// Returns true if the header name equals or matches, case insensitively, a
+// glob in patterns.
+func matchHeader(patterns []string, name string) bool {
+	name = strings.ToLower(name)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if pattern == name {
+			return true
+		}
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
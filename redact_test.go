@@ -0,0 +1,220 @@
+package shadowd
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRedactorHashAndTruncate(t *testing.T) {
+	redactor := &Redactor{HashKey: "k", Rules: []RedactRule{
+		{Key: "GET|token", Action: REDACT_TRUNCATE, Length: 3},
+		{Key: "COOKIE|*", Action: REDACT_HASH},
+		{Key: "SERVER|HTTP_COOKIE", Action: REDACT_DROP},
+	}}
+	inputs := map[string]string{
+		"GET|token":          "abcdef",
+		"COOKIE|a":           "x",
+		"COOKIE|b":           "x",
+		"SERVER|HTTP_COOKIE": "a=x; b=x",
+		"GET|q":              "kept",
+	}
+	redactor.Redact(inputs)
+	if inputs["GET|token"] != "abc" || inputs["GET|q"] != "kept" {
+		t.Errorf("unexpected inputs %q", inputs)
+	}
+	if _, ok := inputs["SERVER|HTTP_COOKIE"]; ok {
+		t.Errorf("SERVER|HTTP_COOKIE not dropped")
+	}
+	if !strings.HasPrefix(inputs["COOKIE|a"], REDACT_HASH_PREFIX) || inputs["COOKIE|a"] != inputs["COOKIE|b"] {
+		t.Errorf("equal values hashed to %q and %q", inputs["COOKIE|a"], inputs["COOKIE|b"])
+	}
+}
+
+// The rproxy example with -shadowd_redact and -shadowd_normalize.
+func TestRedactNormalizedInputs(t *testing.T) {
+	dir := t.TempDir()
+	audit := &AuditLog{Filename: filepath.Join(dir, "audit.log")}
+	transport := &recordingTransport{reply: `{"status":1}`}
+	serverconn := &ShadowdConn{
+		ProfileId:      "1",
+		ProfileKey:     "k",
+		Normalize:      true,
+		ExcludeHeaders: []string{"Authorization", "Proxy-Authorization"},
+		Redactor: &Redactor{HashKey: "k", Rules: []RedactRule{
+			{Key: "COOKIE|*", Action: REDACT_HASH},
+			{Key: "SERVER|HTTP_COOKIE", Action: REDACT_DROP},
+		}},
+		Transport: transport,
+		Sinks:     []Sink{audit},
+	}
+	req, _ := baselineRequest()
+	req.Header.Set("Cookie", "SESSION=s3cr3t%3D%3D")
+	req.Header.Set("Authorization", "Basic czNjcjN0")
+	if _, err := serverconn.Check(req); err != nil {
+		t.Fatal(err)
+	}
+	audit.Close()
+
+	payload := &Payload{}
+	if err := json.Unmarshal(transport.sent[0].Data, payload); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"COOKIE|SESSION", "NORMALIZED|COOKIE|SESSION"} {
+		if !strings.HasPrefix(payload.Input[key], REDACT_HASH_PREFIX) {
+			t.Errorf("%s = %q, want a hash", key, payload.Input[key])
+		}
+	}
+	for _, key := range []string{"SERVER|HTTP_COOKIE", "NORMALIZED|SERVER|HTTP_COOKIE", "SERVER|HTTP_AUTHORIZATION"} {
+		if _, ok := payload.Input[key]; ok {
+			t.Errorf("%s not dropped", key)
+		}
+	}
+
+	contents, err := os.ReadFile(audit.Filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range [][]byte{transport.sent[0].Data, contents} {
+		if strings.Contains(string(data), "s3cr3t") || strings.Contains(string(data), "czNjcjN0") {
+			t.Errorf("credential leaked in %s", data)
+		}
+	}
+}
+
+func TestAuditLogRedactsNormalizedInputs(t *testing.T) {
+	dir := t.TempDir()
+	audit := &AuditLog{Filename: filepath.Join(dir, "audit.log"), Redact: []string{"COOKIE|*"}}
+	audit.HandleEvent(&Event{Inputs: map[string]string{
+		"COOKIE|SESSION":            "s3cr3t%3D",
+		"NORMALIZED|COOKIE|SESSION": "s3cr3t=",
+		"GET|q":                     "kept",
+	}})
+	audit.Close()
+
+	file, err := os.Open(audit.Filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() {
+		t.Fatal("no audit record")
+	}
+	var event Event
+	if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"COOKIE|SESSION":            AUDIT_REDACTED,
+		"NORMALIZED|COOKIE|SESSION": AUDIT_REDACTED,
+		"GET|q":                     "kept",
+	}
+	for k, v := range want {
+		if event.Inputs[k] != v {
+			t.Errorf("%s = %q, want %q", k, event.Inputs[k], v)
+		}
+	}
+}
+
+// A Sink keeping the events.
+type recordingSink struct {
+	events []*Event
+}
+
+func (sink *recordingSink) HandleEvent(event *Event) {
+	sink.events = append(sink.events, event)
+}
+
+func TestRedactQueryArguments(t *testing.T) {
+	target := "/app/index.php?token=s3cr3t&q=1&key=k%33y&list[]=a&list[]=s3cr3t"
+	for _, phpCompat := range []bool{false, true} {
+		audit := &AuditLog{Filename: filepath.Join(t.TempDir(), "audit.log")}
+		sink := &recordingSink{}
+		transport := &recordingTransport{reply: `{"status":6,"threats":["GET|q"]}`}
+		serverconn := &ShadowdConn{
+			ProfileId:  "1",
+			ProfileKey: "k",
+			PHPCompat:  phpCompat,
+			Normalize:  true,
+			Redactor: &Redactor{HashKey: "k", Rules: []RedactRule{
+				{Key: "GET|token", Action: REDACT_DROP},
+				{Key: "GET|key", Action: REDACT_HASH},
+				{Key: "GET|list|1", Action: REDACT_TRUNCATE, Length: 2},
+				{Key: "GET|list[]", Action: REDACT_TRUNCATE, Length: 2},
+			}},
+			Transport: transport,
+			Sinks:     []Sink{audit, sink},
+		}
+		req := httptest.NewRequest("GET", target, nil)
+		if _, err := serverconn.Check(req); err != nil {
+			t.Fatal(err)
+		}
+		audit.Close()
+
+		payload := &Payload{}
+		if err := json.Unmarshal(transport.sent[0].Data, payload); err != nil {
+			t.Fatal(err)
+		}
+		hash := url.QueryEscape(serverconn.Redactor.Hash("k3y"))
+		want := "/app/index.php?q=1&key=" + hash + "&list[]=a&list[]=s3"
+		keys := []string{"SERVER|RAW_REQUEST_URI"}
+		if phpCompat {
+			keys = append(keys, "SERVER|REQUEST_URI")
+			if got := payload.Input["SERVER|QUERY_STRING"]; got != strings.TrimPrefix(want, "/app/index.php?") {
+				t.Errorf("php compat %v: SERVER|QUERY_STRING = %q", phpCompat, got)
+			}
+			if payload.Resource != want {
+				t.Errorf("php compat %v: resource %q, want %q", phpCompat, payload.Resource, want)
+			}
+		}
+		for _, key := range keys {
+			if got := payload.Input[key]; got != want {
+				t.Errorf("php compat %v: %s = %q, want %q", phpCompat, key, got, want)
+			}
+		}
+		event := sink.events[0]
+		if event.URL != want {
+			t.Errorf("php compat %v: event URL %q, want %q", phpCompat, event.URL, want)
+		}
+
+		contents, err := os.ReadFile(audit.Filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, data := range []string{string(transport.sent[0].Data), string(contents), FormatCEF(event), FormatLEEF(event)} {
+			if strings.Contains(data, "s3cr3t") || strings.Contains(data, "k3y") || strings.Contains(data, "k%33y") {
+				t.Errorf("php compat %v: secret leaked in %s", phpCompat, data)
+			}
+		}
+	}
+}
+
+func TestRedactURI(t *testing.T) {
+	redactor := &Redactor{Rules: []RedactRule{{Key: "POST|token", Action: REDACT_DROP}}}
+	tests := []struct {
+		method string
+		uri    string
+		want   string
+	}{
+		{"POST", "/a?token=x&b=1", "/a?b=1"},
+		{"POST", "/a?b=1&tok%65n=x", "/a?b=1"},
+		{"POST", "/a?token", "/a?"},
+		{"GET", "/a?token=x", "/a?token=x"},
+		{"POST", "/a", "/a"},
+		{"POST", "/a?b=%zz&c", "/a?b=%zz&c"},
+	}
+	for _, test := range tests {
+		if got := redactor.RedactURI(test.method, test.uri); got != test.want {
+			t.Errorf("RedactURI(%s, %q) = %q, want %q", test.method, test.uri, got, test.want)
+		}
+	}
+	if got := (*Redactor)(nil).RedactURI("GET", "/a?token=x"); got != "/a?token=x" {
+		t.Errorf("nil Redactor changed the URI to %q", got)
+	}
+}
@@ -0,0 +1,108 @@
+package shadowd
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Matches a request to a route template such as "/users/{id}" and returns
+// the template with the values of its path parameters.
+type RouteMatcher func(req *http.Request) (template string, params map[string]string, ok bool)
+
+// Returns a RouteMatcher trying the templates in order.
+// Templates use the http.ServeMux syntax, "{name}" matches a single path
+// segment, "{name...}" the rest of the path, "{$}" only the end of the path
+// and a trailing "/" any path below it.
+func TemplateMatcher(templates ...string) RouteMatcher {
+	return func(req *http.Request) (string, map[string]string, bool) {
+		for _, template := range templates {
+			if params, ok := matchTemplate(template, req.URL.Path); ok {
+				return template, params, true
+			}
+		}
+		return "", nil, false
+	}
+}
+
+// Returns a RouteMatcher using the patterns registered on an http.ServeMux.
+// The mux is asked which pattern matches the request, so the Middleware may
+// wrap the mux itself or the handlers registered on it. The method and host
+// parts of the pattern are not part of the template.
+func ServeMuxMatcher(mux *http.ServeMux) RouteMatcher {
+	return func(req *http.Request) (string, map[string]string, bool) {
+		_, pattern := mux.Handler(req)
+		if i := strings.IndexByte(pattern, ' '); i >= 0 {
+			pattern = strings.TrimLeft(pattern[i:], " ")
+		}
+		if i := strings.IndexByte(pattern, '/'); i > 0 {
+			pattern = pattern[i:]
+		}
+		if pattern == "" {
+			return "", nil, false
+		}
+		params, ok := matchTemplate(pattern, req.URL.Path)
+		return pattern, params, ok
+	}
+}
+
+// Adds the path parameters of the matched route as PATH|name inputs.
+type RouteExtractor struct {
+	Match RouteMatcher
+}
+
+func (extractor RouteExtractor) Extract(req *http.Request, inputs map[string]string) error {
+	if extractor.Match == nil {
+		return nil
+	}
+	_, params, ok := extractor.Match(req)
+	if !ok {
+		return nil
+	}
+	for name, value := range params {
+		inputs["PATH|"+escapeKey(name)] = value
+	}
+	return nil
+}
+
+// Returns the route template of the request when Routes matched it.
+func (serverconn *ShadowdConn) routeTemplate(req *http.Request) (string, bool) {
+	if serverconn.Routes == nil {
+		return "", false
+	}
+	template, _, ok := serverconn.Routes(req)
+	return template, ok
+}
+
+func matchTemplate(template, urlpath string) (map[string]string, bool) {
+	tsegs := strings.Split(template, "/")
+	psegs := strings.Split(urlpath, "/")
+	params := make(map[string]string)
+	for i, tseg := range tsegs {
+		if i == len(tsegs)-1 && tseg == "" && len(tsegs) > 1 {
+			// a trailing slash matches the whole subtree
+			return params, len(psegs) > i
+		}
+		if tseg == "{$}" {
+			return params, i == len(psegs)-1 && psegs[i] == ""
+		}
+		if i >= len(psegs) {
+			return nil, false
+		}
+		if strings.HasPrefix(tseg, "{") && strings.HasSuffix(tseg, "}") {
+			name := tseg[1 : len(tseg)-1]
+			if strings.HasSuffix(name, "...") {
+				params[strings.TrimSuffix(name, "...")] = strings.Join(psegs[i:], "/")
+				return params, true
+			}
+			if psegs[i] == "" {
+				return nil, false
+			}
+			params[name] = psegs[i]
+			continue
+		}
+		if tseg != psegs[i] {
+			return nil, false
+		}
+	}
+	return params, len(tsegs) == len(psegs)
+}
@@ -0,0 +1,37 @@
+package shadowd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMatchTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		path     string
+		params   map[string]string
+		ok       bool
+	}{
+		{"/users/{id}", "/users/42", map[string]string{"id": "42"}, true},
+		{"/users/{id}", "/users/", nil, false},
+		{"/users/{id}", "/users/42/posts", nil, false},
+		{"/users/{id}/posts/{post}", "/users/42/posts/7", map[string]string{"id": "42", "post": "7"}, true},
+		{"/files/{path...}", "/files/a/b.txt", map[string]string{"path": "a/b.txt"}, true},
+		{"/files/{path...}", "/files/", map[string]string{"path": ""}, true},
+		{"/static/", "/static/css/app.css", map[string]string{}, true},
+		{"/static/", "/static", nil, false},
+		{"/", "/anything/below", map[string]string{}, true},
+		{"/{$}", "/", map[string]string{}, true},
+		{"/{$}", "/index.html", nil, false},
+		{"/a/{$}", "/a/", map[string]string{}, true},
+		{"/about", "/about", map[string]string{}, true},
+		{"/about", "/about/", nil, false},
+		{"/about", "/contact", nil, false},
+	}
+	for _, test := range tests {
+		params, ok := matchTemplate(test.template, test.path)
+		if ok != test.ok || (ok && !reflect.DeepEqual(params, test.params)) {
+			t.Errorf("matchTemplate(%q, %q) = %v, %v, want %v, %v", test.template, test.path, params, ok, test.params, test.ok)
+		}
+	}
+}
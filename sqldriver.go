@@ -0,0 +1,282 @@
+package shadowd
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Returned by the SQLDriver connections when shadowd identified the
+// arguments of a query as an attack.
+type QueryError struct {
+	Query   string
+	Verdict *Verdict
+}
+
+func (err *QueryError) Error() string {
+	return fmt.Sprintf("shadowd: query rejected with status %d, threats: %v", err.Verdict.Status, err.Verdict.Threats)
+}
+
+// Wraps a database/sql driver so the arguments of every query are checked
+// by shadowd before it runs, as a defense against SQL injection in code
+// that builds queries from user data. Register it under a new name:
+//
+//	sql.Register("shadowd-postgres", &shadowd.SQLDriver{Driver: &pq.Driver{}, Conn: &shadowServer})
+//
+// Each argument is sent as an ARG|n input, counting from 1, or ARG|name
+// for named arguments, with the query text as the resource. The caller is
+// Label, or else the function calling into database/sql, so that the
+// rules are learned per call site. ClientIP, when set, returns the client
+// the query is run for from the context passed to the *Context methods.
+//
+// Queries with an attack verdict fail with a *QueryError, queries with
+// any other verdict than STATUS_OK with a *StatusError and queries that
+// could not be checked with the error of the check.
+type SQLDriver struct {
+	Driver   driver.Driver
+	Conn     *ShadowdConn
+	Label    string
+	ClientIP func(ctx context.Context) string
+}
+
+func (d *SQLDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlConn{Conn: conn, driver: d}, nil
+}
+
+// Checks the arguments of query, returns nil when the query may run.
+func (d *SQLDriver) check(ctx context.Context, query string, args []driver.NamedValue) error {
+	meta := Meta{Caller: d.Label, Resource: query}
+	if meta.Caller == "" {
+		meta.Caller = sqlCallSite()
+	}
+	if d.ClientIP != nil {
+		meta.ClientIP = d.ClientIP(ctx)
+	}
+	inputs := make(map[string]string, len(args))
+	for _, arg := range args {
+		key := "ARG|" + strconv.Itoa(arg.Ordinal)
+		if arg.Name != "" {
+			key = "ARG|" + escapeKey(arg.Name)
+		}
+		inputs[key] = sqlValueString(arg.Value)
+	}
+
+	verdict, err := d.Conn.CheckInputs(ctx, meta, inputs)
+	if err == nil && verdict.IsAttack() {
+		err = &QueryError{Query: query, Verdict: verdict}
+	} else if err == nil && verdict.Status != STATUS_OK {
+		err = &StatusError{Verdict: verdict}
+	}
+	if err != nil && d.Conn.Observe {
+		fmt.Println("Query from", meta.Caller, "not blocked in observe mode:", err)
+		return nil
+	}
+	return err
+}
+
+var sqlPackagePrefix = reflect.TypeOf(SQLDriver{}).PkgPath() + "."
+
+// Returns the function that called into database/sql.
+func sqlCallSite() string {
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	for {
+		frame, more := frames.Next()
+		if !strings.HasPrefix(frame.Function, "database/sql.") && !strings.HasPrefix(frame.Function, sqlPackagePrefix) {
+			return frame.Function
+		}
+		if !more {
+			return ""
+		}
+	}
+}
+
+func sqlValueString(value driver.Value) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(value)
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+	}
+	return named
+}
+
+func plainValues(args []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, fmt.Errorf("shadowd: the driver does not support the named argument %q", arg.Name)
+		}
+		values[i] = arg.Value
+	}
+	return values, nil
+}
+
+type sqlConn struct {
+	driver.Conn
+	driver *SQLDriver
+}
+
+func (conn *sqlConn) Prepare(query string) (driver.Stmt, error) {
+	return conn.PrepareContext(context.Background(), query)
+}
+
+func (conn *sqlConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	var err error
+	if preparer, ok := conn.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = preparer.PrepareContext(ctx, query)
+	} else {
+		stmt, err = conn.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sqlStmt{Stmt: stmt, query: query, driver: conn.driver}, nil
+}
+
+func (conn *sqlConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := conn.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	return conn.Conn.Begin()
+}
+
+// Queries of drivers without direct execution are prepared by database/sql
+// and checked by the statement, driver.ErrSkip is returned before checking
+// to not check them twice.
+func (conn *sqlConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, isContext := conn.Conn.(driver.ExecerContext)
+	legacy, isLegacy := conn.Conn.(driver.Execer)
+	if !isContext && !isLegacy {
+		return nil, driver.ErrSkip
+	}
+	if err := conn.driver.check(ctx, query, args); err != nil {
+		return nil, err
+	}
+	if isContext {
+		return execer.ExecContext(ctx, query, args)
+	}
+	values, err := plainValues(args)
+	if err != nil {
+		return nil, err
+	}
+	return legacy.Exec(query, values)
+}
+
+func (conn *sqlConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, isContext := conn.Conn.(driver.QueryerContext)
+	legacy, isLegacy := conn.Conn.(driver.Queryer)
+	if !isContext && !isLegacy {
+		return nil, driver.ErrSkip
+	}
+	if err := conn.driver.check(ctx, query, args); err != nil {
+		return nil, err
+	}
+	if isContext {
+		return queryer.QueryContext(ctx, query, args)
+	}
+	values, err := plainValues(args)
+	if err != nil {
+		return nil, err
+	}
+	return legacy.Query(query, values)
+}
+
+func (conn *sqlConn) Ping(ctx context.Context) error {
+	if pinger, ok := conn.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (conn *sqlConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := conn.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (conn *sqlConn) IsValid() bool {
+	if validator, ok := conn.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+func (conn *sqlConn) CheckNamedValue(value *driver.NamedValue) error {
+	if checker, ok := conn.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(value)
+	}
+	return driver.ErrSkip
+}
+
+type sqlStmt struct {
+	driver.Stmt
+	query  string
+	driver *SQLDriver
+}
+
+func (stmt *sqlStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return stmt.ExecContext(context.Background(), namedValues(args))
+}
+
+func (stmt *sqlStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return stmt.QueryContext(context.Background(), namedValues(args))
+}
+
+func (stmt *sqlStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	if err := stmt.driver.check(ctx, stmt.query, args); err != nil {
+		return nil, err
+	}
+	if execer, ok := stmt.Stmt.(driver.StmtExecContext); ok {
+		return execer.ExecContext(ctx, args)
+	}
+	values, err := plainValues(args)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.Stmt.Exec(values)
+}
+
+func (stmt *sqlStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	if err := stmt.driver.check(ctx, stmt.query, args); err != nil {
+		return nil, err
+	}
+	if queryer, ok := stmt.Stmt.(driver.StmtQueryContext); ok {
+		return queryer.QueryContext(ctx, args)
+	}
+	values, err := plainValues(args)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.Stmt.Query(values)
+}
+
+func (stmt *sqlStmt) CheckNamedValue(value *driver.NamedValue) error {
+	if checker, ok := stmt.Stmt.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(value)
+	}
+	return driver.ErrSkip
+}
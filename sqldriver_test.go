@@ -0,0 +1,308 @@
+package shadowd_test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"github.com/elico/go-shadowd"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A Transport flagging the payloads with an input containing "' OR" and
+// replying with status n to an input "status=n".
+type sqlTransport struct {
+	mutex    sync.Mutex
+	payloads []*shadowd.Payload
+}
+
+func (transport *sqlTransport) Send(ctx context.Context, signed *shadowd.SignedPayload) (string, error) {
+	payload := &shadowd.Payload{}
+	if err := json.Unmarshal(signed.Data, payload); err != nil {
+		return "", err
+	}
+	transport.mutex.Lock()
+	transport.payloads = append(transport.payloads, payload)
+	transport.mutex.Unlock()
+	for key, value := range payload.Input {
+		if strings.Contains(value, "' OR") {
+			return `{"status":5,"threats":["` + key + `"]}`, nil
+		}
+		if status, ok := strings.CutPrefix(value, "status="); ok {
+			return `{"status":` + status + `}`, nil
+		}
+	}
+	return `{"status":1}`, nil
+}
+
+func (transport *sqlTransport) last() *shadowd.Payload {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	if len(transport.payloads) == 0 {
+		return nil
+	}
+	return transport.payloads[len(transport.payloads)-1]
+}
+
+func (transport *sqlTransport) count() int {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	return len(transport.payloads)
+}
+
+// A fake driver recording the statements it runs. Its connections execute
+// queries directly with the context interfaces, with the legacy ones, or
+// only through prepared statements.
+type fakeDriver struct {
+	mode     string
+	mutex    sync.Mutex
+	executed []string
+}
+
+func (d *fakeDriver) Open(name string) (driver.Conn, error) {
+	conn := &fakeConn{driver: d}
+	switch d.mode {
+	case "context":
+		return &fakeContextConn{conn}, nil
+	case "legacy":
+		return &fakeLegacyConn{conn}, nil
+	}
+	return conn, nil
+}
+
+func (d *fakeDriver) run(query string) {
+	d.mutex.Lock()
+	d.executed = append(d.executed, query)
+	d.mutex.Unlock()
+}
+
+func (d *fakeDriver) ran() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]string(nil), d.executed...)
+}
+
+type fakeConn struct {
+	driver *fakeDriver
+}
+
+func (conn *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{conn: conn, query: query}, nil
+}
+func (conn *fakeConn) Close() error              { return nil }
+func (conn *fakeConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+
+type fakeContextConn struct {
+	*fakeConn
+}
+
+func (conn *fakeContextConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	conn.driver.run(query)
+	return driver.RowsAffected(1), nil
+}
+
+func (conn *fakeContextConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	conn.driver.run(query)
+	return &fakeRows{}, nil
+}
+
+type fakeLegacyConn struct {
+	*fakeConn
+}
+
+func (conn *fakeLegacyConn) Exec(query string, args []driver.Value) (driver.Result, error) {
+	conn.driver.run(query)
+	return driver.RowsAffected(1), nil
+}
+
+func (conn *fakeLegacyConn) Query(query string, args []driver.Value) (driver.Rows, error) {
+	conn.driver.run(query)
+	return &fakeRows{}, nil
+}
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+func (stmt *fakeStmt) Close() error  { return nil }
+func (stmt *fakeStmt) NumInput() int { return -1 }
+
+func (stmt *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	stmt.conn.driver.run(stmt.query)
+	return driver.RowsAffected(1), nil
+}
+
+func (stmt *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	stmt.conn.driver.run(stmt.query)
+	return &fakeRows{}, nil
+}
+
+type fakeRows struct{}
+
+func (*fakeRows) Columns() []string              { return []string{"id"} }
+func (*fakeRows) Close() error                   { return nil }
+func (*fakeRows) Next(dest []driver.Value) error { return io.EOF }
+
+var driverCount int
+var driverMutex sync.Mutex
+
+// Registers the fake driver wrapped by sqlDriver and opens a database.
+func openDB(t *testing.T, sqlDriver *shadowd.SQLDriver) *sql.DB {
+	driverMutex.Lock()
+	driverCount++
+	name := "shadowd-fake-" + strconv.Itoa(driverCount)
+	driverMutex.Unlock()
+	sql.Register(name, sqlDriver)
+	db, err := sql.Open(name, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func newSQLDriver(mode string) (*shadowd.SQLDriver, *fakeDriver, *sqlTransport) {
+	fake := &fakeDriver{mode: mode}
+	transport := &sqlTransport{}
+	conn := &shadowd.ShadowdConn{ProfileId: "1", ProfileKey: "k", Transport: transport}
+	return &shadowd.SQLDriver{Driver: fake, Conn: conn, Label: "users"}, fake, transport
+}
+
+const userQuery = "SELECT id FROM users WHERE name = ?"
+
+func TestSQLDriverExecAndQuery(t *testing.T) {
+	for _, mode := range []string{"context", "legacy", "prepare"} {
+		sqlDriver, fake, transport := newSQLDriver(mode)
+		db := openDB(t, sqlDriver)
+
+		if _, err := db.Exec(userQuery, "alice"); err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		payload := transport.last()
+		if payload == nil || payload.Input["ARG|1"] != "alice" || payload.Resource != userQuery || payload.Caller != "users" {
+			t.Errorf("%s: unexpected payload %+v", mode, payload)
+		}
+		rows, err := db.Query(userQuery, "bob")
+		if err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		rows.Close()
+
+		_, err = db.Exec(userQuery, "x' OR '1'='1")
+		var queryErr *shadowd.QueryError
+		if !errors.As(err, &queryErr) || queryErr.Query != userQuery || !queryErr.Verdict.IsAttack() {
+			t.Errorf("%s: got %v, want a QueryError", mode, err)
+		}
+		_, err = db.Query(userQuery, "x' OR '1'='1")
+		if !errors.As(err, &queryErr) {
+			t.Errorf("%s: got %v, want a QueryError", mode, err)
+		}
+
+		// the ErrSkip fallback of the prepare mode checks the arguments once
+		if got := transport.count(); got != 4 {
+			t.Errorf("%s: %d checks, want 4", mode, got)
+		}
+		if got := fake.ran(); len(got) != 2 {
+			t.Errorf("%s: driver ran %q, want the 2 accepted queries", mode, got)
+		}
+	}
+}
+
+func TestSQLDriverPreparedStatement(t *testing.T) {
+	sqlDriver, fake, transport := newSQLDriver("context")
+	db := openDB(t, sqlDriver)
+	stmt, err := db.Prepare(userQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+
+	ctx := context.Background()
+	if _, err := stmt.ExecContext(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if rows, err := stmt.QueryContext(ctx, "bob"); err != nil {
+		t.Fatal(err)
+	} else {
+		rows.Close()
+	}
+	var queryErr *shadowd.QueryError
+	if _, err := stmt.ExecContext(ctx, "x' OR 1=1 --"); !errors.As(err, &queryErr) {
+		t.Errorf("got %v, want a QueryError", err)
+	}
+	if transport.count() != 3 || len(fake.ran()) != 2 {
+		t.Errorf("%d checks and %d queries run, want 3 and 2", transport.count(), len(fake.ran()))
+	}
+}
+
+func TestSQLDriverNamedArguments(t *testing.T) {
+	sqlDriver, _, transport := newSQLDriver("context")
+	sqlDriver.ClientIP = func(ctx context.Context) string { return "192.0.2.1" }
+	db := openDB(t, sqlDriver)
+	if _, err := db.Exec("UPDATE users SET a = @a WHERE b = @b", sql.Named("a", "1"), sql.Named("b", []byte("2"))); err != nil {
+		t.Fatal(err)
+	}
+	payload := transport.last()
+	if payload.Input["ARG|a"] != "1" || payload.Input["ARG|b"] != "2" || payload.ClientIP != "192.0.2.1" {
+		t.Errorf("unexpected payload %+v", payload)
+	}
+
+	// drivers without the context interfaces cannot take named arguments
+	sqlDriver, fake, _ := newSQLDriver("legacy")
+	db = openDB(t, sqlDriver)
+	if _, err := db.Exec("UPDATE users SET a = @a", sql.Named("a", "1")); err == nil || len(fake.ran()) != 0 {
+		t.Errorf("named argument passed to a legacy driver, err %v", err)
+	}
+}
+
+func TestSQLDriverStatus(t *testing.T) {
+	for _, status := range []int{shadowd.STATUS_BAD_REQUEST, shadowd.STATUS_BAD_SIGNATURE, shadowd.STATUS_BAD_JSON} {
+		sqlDriver, fake, _ := newSQLDriver("context")
+		db := openDB(t, sqlDriver)
+		_, err := db.Exec(userQuery, "status="+strconv.Itoa(status))
+		var statusErr *shadowd.StatusError
+		if !errors.As(err, &statusErr) || statusErr.Verdict.Status != status {
+			t.Errorf("status %d: got error %v", status, err)
+		}
+		if len(fake.ran()) != 0 {
+			t.Errorf("status %d: the query ran", status)
+		}
+	}
+}
+
+func TestSQLDriverObserve(t *testing.T) {
+	for _, value := range []string{"x' OR '1'='1", "status=3"} {
+		sqlDriver, fake, _ := newSQLDriver("context")
+		sqlDriver.Conn.Observe = true
+		db := openDB(t, sqlDriver)
+		if _, err := db.Exec(userQuery, value); err != nil {
+			t.Errorf("%s: %v", value, err)
+		}
+		if len(fake.ran()) != 1 {
+			t.Errorf("%s: the query did not run", value)
+		}
+	}
+}
+
+func TestSQLDriverCallSite(t *testing.T) {
+	sqlDriver, _, transport := newSQLDriver("context")
+	sqlDriver.Label = ""
+	db := openDB(t, sqlDriver)
+	if _, err := db.Exec(userQuery, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if caller := transport.last().Caller; caller != "github.com/elico/go-shadowd_test.TestSQLDriverCallSite" {
+		t.Errorf("got caller %q", caller)
+	}
+}
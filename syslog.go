@@ -0,0 +1,233 @@
+package shadowd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Syslog message formats.
+const (
+	FORMAT_CEF  = "cef"
+	FORMAT_LEEF = "leef"
+)
+
+// The syslog facility used when SyslogSink.Facility is zero (log audit).
+const SYSLOG_DEFAULT_FACILITY = 13
+
+// How many messages wait for the syslog server before new ones are dropped,
+// and how long the sink waits before reconnecting after a failure.
+const (
+	SYSLOG_QUEUE_SIZE  = 1000
+	SYSLOG_RETRY_DELAY = 5 * time.Second
+)
+
+// A Sink sending attack and critical attack events to a syslog server as
+// RFC 5424 messages carrying a CEF or LEEF formatted payload.
+// Network is "udp", "tcp", "unix" or "unixgram", messages sent over stream
+// connections are framed with octet counting (RFC 6587).
+// STATUS_ATTACK maps to the warning syslog severity and CEF/LEEF severity 7,
+// STATUS_CRITICAL_ATTACK to the critical syslog severity and severity 10.
+//
+// Messages are queued and sent from a goroutine, so an unreachable server
+// does not delay the checks. While the server is unreachable, and when the
+// queue is full, messages are dropped.
+type SyslogSink struct {
+	Network  string
+	Addr     string
+	Format   string
+	Facility int
+	AppName  string
+	Hostname string
+
+	queueMutex sync.Mutex
+	queue      chan []byte
+	done       chan struct{}
+	closed     bool
+
+	mutex sync.Mutex
+	conn  net.Conn
+	retry time.Time
+}
+
+// Returns a SyslogSink connected to addr.
+func NewSyslogSink(network, addr, format string) (*SyslogSink, error) {
+	hostname, _ := os.Hostname()
+	sink := &SyslogSink{Network: network, Addr: addr, Format: format, Hostname: hostname}
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	err := sink.connect()
+	if err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+// Queues attack events, other events are ignored.
+func (sink *SyslogSink) HandleEvent(event *Event) {
+	if event.Status != STATUS_ATTACK && event.Status != STATUS_CRITICAL_ATTACK {
+		return
+	}
+	msg := sink.Message(event)
+
+	sink.queueMutex.Lock()
+	defer sink.queueMutex.Unlock()
+	if sink.closed {
+		return
+	}
+	if sink.queue == nil {
+		sink.queue = make(chan []byte, SYSLOG_QUEUE_SIZE)
+		sink.done = make(chan struct{})
+		go sink.run(sink.queue, sink.done)
+	}
+	select {
+	case sink.queue <- msg:
+	default:
+		fmt.Println("Syslog queue full, dropping event", event.Id)
+	}
+}
+
+// Sends the queued messages until the queue is closed.
+func (sink *SyslogSink) run(queue chan []byte, done chan struct{}) {
+	defer close(done)
+	for msg := range queue {
+		sink.send(msg)
+	}
+}
+
+func (sink *SyslogSink) send(msg []byte) {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	for attempt := 0; attempt < 2; attempt++ {
+		if sink.conn == nil {
+			if time.Now().Before(sink.retry) {
+				return
+			}
+			if err := sink.connect(); err != nil {
+				fmt.Println("Error connecting to syslog:", err)
+				sink.retry = time.Now().Add(SYSLOG_RETRY_DELAY)
+				return
+			}
+		}
+		sink.conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+		_, err := sink.conn.Write(msg)
+		if err == nil {
+			return
+		}
+		fmt.Println("Error writing to syslog:", err)
+		sink.conn.Close()
+		sink.conn = nil
+	}
+}
+
+// Sends the queued messages and closes the syslog connection, later events
+// are ignored.
+func (sink *SyslogSink) Close() error {
+	sink.queueMutex.Lock()
+	sink.closed = true
+	queue, done := sink.queue, sink.done
+	sink.queue = nil
+	sink.queueMutex.Unlock()
+	if queue != nil {
+		close(queue)
+		<-done
+	}
+
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	if sink.conn == nil {
+		return nil
+	}
+	err := sink.conn.Close()
+	sink.conn = nil
+	return err
+}
+
+// Returns the framed RFC 5424 message for the event.
+func (sink *SyslogSink) Message(event *Event) []byte {
+	facility := sink.Facility
+	if facility == 0 {
+		facility = SYSLOG_DEFAULT_FACILITY
+	}
+	severity := 4
+	if event.Status == STATUS_CRITICAL_ATTACK {
+		severity = 2
+	}
+	appName := sink.AppName
+	if appName == "" {
+		appName = "go-shadowd"
+	}
+	hostname := sink.Hostname
+	if hostname == "" {
+		hostname = "-"
+	}
+	var payload string
+	if sink.Format == FORMAT_LEEF {
+		payload = FormatLEEF(event)
+	} else {
+		payload = FormatCEF(event)
+	}
+	msg := fmt.Sprintf("<%d>1 %s %s %s %d %s - %s",
+		facility*8+severity, event.Time.UTC().Format(time.RFC3339Nano), hostname, appName,
+		os.Getpid(), statusNames[event.Status], payload)
+	if sink.Network == "tcp" || sink.Network == "unix" {
+		msg = strconv.Itoa(len(msg)) + " " + msg
+	}
+	return []byte(msg)
+}
+
+// Must be called with the mutex held.
+func (sink *SyslogSink) connect() error {
+	conn, err := net.DialTimeout(sink.Network, sink.Addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	sink.conn = conn
+	return nil
+}
+
+func attackSeverity(status int) (string, int) {
+	if status == STATUS_CRITICAL_ATTACK {
+		return "Critical attack", 10
+	}
+	return "Attack", 7
+}
+
+// Formats an attack event as an ArcSight Common Event Format record.
+func FormatCEF(event *Event) string {
+	name, severity := attackSeverity(event.Status)
+	header := strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+	ext := strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`)
+	return fmt.Sprintf("CEF:0|shadowd|%s|%s|%d|%s|%d|rt=%d src=%s requestMethod=%s dhost=%s request=%s "+
+		"cs1Label=threats cs1=%s cs2Label=caller cs2=%s externalId=%s",
+		header.Replace("go-shadowd"), header.Replace(VERSION), event.Status, name, severity,
+		event.Time.UnixNano()/int64(time.Millisecond), ext.Replace(event.ClientIP), ext.Replace(event.Method),
+		ext.Replace(event.Host), ext.Replace(event.URL), ext.Replace(strings.Join(event.Threats, ",")),
+		ext.Replace(event.Caller), ext.Replace(event.Id))
+}
+
+// Formats an attack event as an IBM QRadar Log Event Extended Format 1.0 record.
+func FormatLEEF(event *Event) string {
+	name, severity := attackSeverity(event.Status)
+	header := strings.NewReplacer(`|`, `\|`)
+	value := strings.NewReplacer("\t", " ", "\r", " ", "\n", " ")
+	fields := []string{
+		"devTime=" + event.Time.UTC().Format("Jan 02 2006 15:04:05.000"),
+		"devTimeFormat=MMM dd yyyy HH:mm:ss.SSS",
+		"cat=" + name,
+		"sev=" + strconv.Itoa(severity),
+		"src=" + value.Replace(event.ClientIP),
+		"method=" + value.Replace(event.Method),
+		"dhost=" + value.Replace(event.Host),
+		"url=" + value.Replace(event.URL),
+		"threats=" + value.Replace(strings.Join(event.Threats, ",")),
+		"caller=" + value.Replace(event.Caller),
+		"incidentId=" + value.Replace(event.Id),
+	}
+	return fmt.Sprintf("LEEF:1.0|shadowd|go-shadowd|%s|%d|%s",
+		header.Replace(VERSION), event.Status, strings.Join(fields, "\t"))
+}
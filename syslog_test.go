@@ -0,0 +1,188 @@
+package shadowd
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testEvent(status int) *Event {
+	return &Event{
+		Time:     time.Date(2024, 5, 1, 12, 30, 45, 123000000, time.UTC),
+		Id:       "42",
+		ClientIP: "192.0.2.1",
+		Method:   "GET",
+		Host:     "example.com",
+		URL:      "/search?q=a=b|c\\d\nx",
+		Caller:   "/search",
+		Status:   status,
+		Threats:  []string{"GET|q", "SERVER|HTTP_USER_AGENT"},
+	}
+}
+
+func TestFormatCEF(t *testing.T) {
+	got := FormatCEF(testEvent(STATUS_ATTACK))
+	want := "CEF:0|shadowd|go-shadowd|" + VERSION + "|5|Attack|7|rt=1714566645123 src=192.0.2.1 requestMethod=GET " +
+		`dhost=example.com request=/search?q\=a\=b|c\\d\nx cs1Label=threats cs1=GET|q,SERVER|HTTP_USER_AGENT ` +
+		"cs2Label=caller cs2=/search externalId=42"
+	if got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+	if got := FormatCEF(testEvent(STATUS_CRITICAL_ATTACK)); !strings.Contains(got, "|6|Critical attack|10|") {
+		t.Errorf("critical attack severity missing in %s", got)
+	}
+}
+
+func TestFormatLEEF(t *testing.T) {
+	event := testEvent(STATUS_CRITICAL_ATTACK)
+	event.Caller = "a\tb"
+	got := FormatLEEF(event)
+	want := "LEEF:1.0|shadowd|go-shadowd|" + VERSION + "|6|" + strings.Join([]string{
+		"devTime=May 01 2024 12:30:45.123",
+		"devTimeFormat=MMM dd yyyy HH:mm:ss.SSS",
+		"cat=Critical attack",
+		"sev=10",
+		"src=192.0.2.1",
+		"method=GET",
+		"dhost=example.com",
+		"url=/search?q=a=b|c\\d x",
+		"threats=GET|q,SERVER|HTTP_USER_AGENT",
+		"caller=a b",
+		"incidentId=42",
+	}, "\t")
+	if got != want {
+		t.Errorf("got  %q\nwant %q", got, want)
+	}
+}
+
+func TestSyslogMessage(t *testing.T) {
+	tests := []struct {
+		network  string
+		status   int
+		priority string
+		framed   bool
+	}{
+		{"udp", STATUS_ATTACK, "<108>", false},
+		{"udp", STATUS_CRITICAL_ATTACK, "<106>", false},
+		{"tcp", STATUS_ATTACK, "<108>", true},
+		{"unix", STATUS_ATTACK, "<108>", true},
+		{"unixgram", STATUS_ATTACK, "<108>", false},
+	}
+	for _, test := range tests {
+		sink := &SyslogSink{Network: test.network, Hostname: "web1", Format: FORMAT_LEEF}
+		msg := string(sink.Message(testEvent(test.status)))
+		if test.framed {
+			length, rest, ok := strings.Cut(msg, " ")
+			if !ok || length != strconv.Itoa(len(rest)) {
+				t.Errorf("%s: bad octet counting frame in %q", test.network, msg)
+				continue
+			}
+			msg = rest
+		}
+		prefix := test.priority + "1 2024-05-01T12:30:45.123Z web1 go-shadowd " + strconv.Itoa(os.Getpid()) + " "
+		if !strings.HasPrefix(msg, prefix) || !strings.Contains(msg, " - LEEF:1.0|") {
+			t.Errorf("%s: got %q, want prefix %q", test.network, msg, prefix)
+		}
+	}
+}
+
+func TestSyslogSinkUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sink, err := NewSyslogSink("udp", conn.LocalAddr().String(), FORMAT_CEF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.HandleEvent(testEvent(STATUS_OK))
+	sink.HandleEvent(testEvent(STATUS_CRITICAL_ATTACK))
+	sink.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4096)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := string(buf[:n]); !strings.HasPrefix(msg, "<106>1 ") || !strings.Contains(msg, "critical_attack - CEF:0|") {
+		t.Errorf("unexpected message %q", msg)
+	}
+}
+
+func TestSyslogSinkTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan []string)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(received)
+			return
+		}
+		defer conn.Close()
+		var msgs []string
+		reader := bufio.NewReader(conn)
+		for {
+			length, err := reader.ReadString(' ')
+			if err != nil {
+				break
+			}
+			n, _ := strconv.Atoi(strings.TrimSpace(length))
+			msg := make([]byte, n)
+			if _, err := io.ReadFull(reader, msg); err != nil {
+				break
+			}
+			msgs = append(msgs, string(msg))
+		}
+		received <- msgs
+	}()
+
+	sink, err := NewSyslogSink("tcp", listener.Addr().String(), FORMAT_CEF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.HandleEvent(testEvent(STATUS_ATTACK))
+	sink.HandleEvent(testEvent(STATUS_CRITICAL_ATTACK))
+	sink.Close()
+	sink.HandleEvent(testEvent(STATUS_ATTACK))
+
+	msgs := <-received
+	if len(msgs) != 2 || !strings.HasPrefix(msgs[0], "<108>1 ") || !strings.HasPrefix(msgs[1], "<106>1 ") {
+		t.Errorf("unexpected messages %q", msgs)
+	}
+}
+
+func TestSyslogSinkDoesNotBlock(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sink, err := NewSyslogSink("udp", conn.LocalAddr().String(), FORMAT_CEF)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A send stuck on the network holds the connection mutex.
+	sink.mutex.Lock()
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		sink.HandleEvent(testEvent(STATUS_ATTACK))
+	}
+	elapsed := time.Since(start)
+	sink.mutex.Unlock()
+	if elapsed > 100*time.Millisecond {
+		t.Errorf("HandleEvent took %v while the server was stalled", elapsed)
+	}
+	sink.Close()
+}
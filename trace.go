@@ -0,0 +1,107 @@
+package shadowd
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// A minimal tracer, small enough to be adapted to OpenTelemetry or any
+// other tracing library. Start is called with the request context that
+// carries the incoming W3C trace context, see TraceFromContext.
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// A span created by a Tracer.
+// Spans may also implement "TraceId() string", which is used for the
+// trace ID input when the incoming request has no traceparent header.
+type Span interface {
+	SetAttribute(key string, value interface{})
+	RecordError(err error)
+	End()
+}
+
+// A W3C trace context as sent in the traceparent header.
+type TraceContext struct {
+	TraceId string
+	SpanId  string
+	Flags   string
+}
+
+const traceContextKey contextKey = 1
+
+// Parses a W3C traceparent header value, such as
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01". Version 00
+// has exactly four fields, later versions may append more.
+func ParseTraceparent(value string) (TraceContext, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return TraceContext{}, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return TraceContext{}, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return TraceContext{}, false
+	}
+	for _, part := range parts[:4] {
+		if _, err := hex.DecodeString(part); err != nil {
+			return TraceContext{}, false
+		}
+	}
+	if parts[1] == strings.Repeat("0", 32) || parts[2] == strings.Repeat("0", 16) {
+		return TraceContext{}, false
+	}
+	return TraceContext{TraceId: parts[1], SpanId: parts[2], Flags: parts[3]}, true
+}
+
+// Returns the traceparent header value of the trace context.
+func (tc TraceContext) String() string {
+	return "00-" + tc.TraceId + "-" + tc.SpanId + "-" + tc.Flags
+}
+
+// Returns a copy of ctx carrying the trace context.
+func ContextWithTrace(ctx context.Context, tc TraceContext) context.Context {
+	return context.WithValue(ctx, traceContextKey, tc)
+}
+
+// Returns the incoming trace context stored in ctx by the connector.
+func TraceFromContext(ctx context.Context) (TraceContext, bool) {
+	tc, ok := ctx.Value(traceContextKey).(TraceContext)
+	return tc, ok
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value interface{}) {}
+func (noopSpan) RecordError(err error)                      {}
+func (noopSpan) End()                                       {}
+
+// Starts the span of a shadowd check, propagating the traceparent of the
+// request. Returns a no-op span when no Tracer is set.
+func (serverconn *ShadowdConn) startSpan(req *http.Request) (Span, string) {
+	ctx := req.Context()
+	if tc, ok := ParseTraceparent(req.Header.Get("Traceparent")); ok {
+		ctx = ContextWithTrace(ctx, tc)
+	}
+	return serverconn.startContextSpan(ctx)
+}
+
+// Starts the span of a check under the trace of the context.
+func (serverconn *ShadowdConn) startContextSpan(ctx context.Context) (Span, string) {
+	tc, traced := TraceFromContext(ctx)
+	if serverconn.Tracer == nil {
+		return noopSpan{}, tc.TraceId
+	}
+	_, span := serverconn.Tracer.Start(ctx, "shadowd.check")
+	span.SetAttribute("shadowd.profile_id", serverconn.ProfileId)
+	span.SetAttribute("shadowd.server", serverconn.ServerAddr)
+	if !traced {
+		if withId, ok := span.(interface{ TraceId() string }); ok {
+			return span, withId.TraceId()
+		}
+	}
+	return span, tc.TraceId
+}
@@ -0,0 +1,121 @@
+package shadowd
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+const (
+	testTraceId = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testSpanId  = "00f067aa0ba902b7"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		value string
+		ok    bool
+	}{
+		{"00-" + testTraceId + "-" + testSpanId + "-01", true},
+		{" 00-" + testTraceId + "-" + testSpanId + "-00 ", true},
+		{"01-" + testTraceId + "-" + testSpanId + "-01-future", true},
+		{"00-" + testTraceId + "-" + testSpanId + "-01-extra", false},
+		{"ff-" + testTraceId + "-" + testSpanId + "-01", false},
+		{"00-" + testTraceId + "-" + testSpanId, false},
+		{"00-" + testTraceId[1:] + "-" + testSpanId + "-01", false},
+		{"00-" + testTraceId + "-" + testSpanId + "-1", false},
+		{"00-" + testTraceId + "-0g" + testSpanId[2:] + "-01", false},
+		{"00-00000000000000000000000000000000-" + testSpanId + "-01", false},
+		{"00-" + testTraceId + "-0000000000000000-01", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		tc, ok := ParseTraceparent(test.value)
+		if ok != test.ok {
+			t.Errorf("ParseTraceparent(%q) = %v, want %v", test.value, ok, test.ok)
+			continue
+		}
+		if ok && (tc.TraceId != testTraceId || tc.SpanId != testSpanId) {
+			t.Errorf("ParseTraceparent(%q) = %+v", test.value, tc)
+		}
+	}
+	tc := TraceContext{TraceId: testTraceId, SpanId: testSpanId, Flags: "01"}
+	if got, _ := ParseTraceparent(tc.String()); got != tc {
+		t.Errorf("got %+v after a round trip, want %+v", got, tc)
+	}
+}
+
+// A Tracer recording the spans it starts.
+type testTracer struct {
+	parents []TraceContext
+	spans   []*testSpan
+}
+
+func (tracer *testTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	tc, _ := TraceFromContext(ctx)
+	tracer.parents = append(tracer.parents, tc)
+	span := &testSpan{attributes: make(map[string]interface{})}
+	tracer.spans = append(tracer.spans, span)
+	return ctx, span
+}
+
+type testSpan struct {
+	attributes map[string]interface{}
+	ended      bool
+}
+
+func (span *testSpan) SetAttribute(key string, value interface{}) { span.attributes[key] = value }
+func (span *testSpan) RecordError(err error)                      {}
+func (span *testSpan) End()                                       { span.ended = true }
+func (span *testSpan) TraceId() string                            { return "0af7651916cd43dd8448eb211c80319c" }
+
+func TestTracePropagation(t *testing.T) {
+	tests := []struct {
+		traceparent string
+		traceId     string
+	}{
+		{"00-" + testTraceId + "-" + testSpanId + "-01", testTraceId},
+		{"00-" + testTraceId + "-" + testSpanId + "-01-extra", "0af7651916cd43dd8448eb211c80319c"},
+		{"", "0af7651916cd43dd8448eb211c80319c"},
+	}
+	for _, test := range tests {
+		transport := &recordingTransport{reply: `{"status":1}`}
+		tracer := &testTracer{}
+		serverconn := &ShadowdConn{ProfileId: "1", ProfileKey: "k", Transport: transport, Tracer: tracer, TraceInput: true}
+		req := httptest.NewRequest("GET", "/?q=1", nil)
+		if test.traceparent != "" {
+			req.Header.Set("Traceparent", test.traceparent)
+		}
+		if _, err := serverconn.Check(req); err != nil {
+			t.Fatal(err)
+		}
+		if len(tracer.spans) != 1 || !tracer.spans[0].ended || tracer.spans[0].attributes["shadowd.status"] != STATUS_OK {
+			t.Errorf("%q: unexpected spans %+v", test.traceparent, tracer.spans)
+			continue
+		}
+		if parent := tracer.parents[0].TraceId; parent != "" && parent != testTraceId {
+			t.Errorf("%q: span started under trace %s", test.traceparent, parent)
+		}
+		payload := &Payload{}
+		if err := json.Unmarshal(transport.sent[0].Data, payload); err != nil {
+			t.Fatal(err)
+		}
+		if got := payload.Input["SERVER|TRACE_ID"]; got != test.traceId {
+			t.Errorf("%q: sent trace id %q, want %q", test.traceparent, got, test.traceId)
+		}
+	}
+
+	// without a Tracer the incoming trace id is still sent
+	transport := &recordingTransport{reply: `{"status":1}`}
+	serverconn := &ShadowdConn{ProfileId: "1", ProfileKey: "k", Transport: transport, TraceInput: true}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Traceparent", "00-"+testTraceId+"-"+testSpanId+"-01")
+	payload, err := serverconn.BuildPayload(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := payload.Input["SERVER|TRACE_ID"]; got != testTraceId {
+		t.Errorf("sent trace id %q without a tracer, want %s", got, testTraceId)
+	}
+}
@@ -0,0 +1,57 @@
+package shadowd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Sends a signed payload to shadowd and returns its json reply line.
+type Transport interface {
+	Send(ctx context.Context, payload *SignedPayload) (string, error)
+}
+
+// The default Transport, opening a tcp connection to Addr per payload.
+// A zero Timeout waits for shadowd as long as the context allows.
+type TCPTransport struct {
+	Addr    string
+	Timeout time.Duration
+}
+
+// Sends the payload using the shadowd wire format, the profile ID, the
+// signature and the json data each followed by a newline.
+func (transport *TCPTransport) Send(ctx context.Context, payload *SignedPayload) (string, error) {
+	if transport.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, transport.Timeout)
+		defer cancel()
+	}
+	//send the fomratted string into the shadowd server at port 9115
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", transport.Addr)
+	if err != nil {
+		fmt.Println("Couldn't connect to server:", transport.Addr, err.Error())
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// Sending data to the server
+	_, err = fmt.Fprintf(conn, "%s\n%s\n%s\n", payload.ProfileId, payload.Signature, string(payload.Data))
+	if err != nil {
+		fmt.Println("Error writing to the server:", err.Error())
+		return "", err
+	}
+
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		fmt.Println("Error reading from the server:", err.Error())
+		return "", err
+	}
+	return line, nil
+}
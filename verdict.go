@@ -0,0 +1,70 @@
+package shadowd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Verdict sources, a verdict is either returned by shadowd or synthesized
+// locally by the connector.
+const (
+	SOURCE_SHADOWD     = "shadowd"
+	SOURCE_ACCESS_LIST = "access_list"
+	SOURCE_BAN_LIST    = "ban_list"
+	SOURCE_POLICY      = "policy"
+	SOURCE_GRAPHQL     = "graphql"
+)
+
+// An analysis result as returned by the shadowd server.
+// Status is one of the STATUS_X constants and Threats holds the input
+// paths that were flagged by shadowd.
+// Latency is the round trip time to Server, both are empty for verdicts
+// that were synthesized locally. Lossy is set when some inputs reached
+// shadowd altered by a lossy UTF-8 conversion.
+type Verdict struct {
+	Status  int           `json:"status"`
+	Threats []string      `json:"threats,omitempty"`
+	Source  string        `json:"-"`
+	Server  string        `json:"-"`
+	Latency time.Duration `json:"-"`
+	Lossy   bool          `json:"-"`
+}
+
+// Parses the json string returned by SendToShadowd into a Verdict.
+func ParseVerdict(res string) (*Verdict, error) {
+	verdict := &Verdict{Source: SOURCE_SHADOWD}
+	err := json.Unmarshal([]byte(res), verdict)
+	if err != nil {
+		return nil, err
+	}
+	return verdict, nil
+}
+
+// Returns true if shadowd identified the request or the requester as an attack.
+func (verdict *Verdict) IsAttack() bool {
+	return verdict.Status == STATUS_ATTACK || verdict.Status == STATUS_CRITICAL_ATTACK
+}
+
+// Returned by the wrappers for verdicts that are neither STATUS_OK nor an
+// attack, when shadowd could not analyse the inputs.
+type StatusError struct {
+	Verdict *Verdict
+}
+
+func (err *StatusError) Error() string {
+	return fmt.Sprintf("shadowd: inputs not analysed, status %d", err.Verdict.Status)
+}
+
+// Sends the request to shadowd and returns the parsed verdict.
+func (serverconn *ShadowdConn) Check(req *http.Request) (*Verdict, error) {
+	res, verdict, err := serverconn.send(req)
+	if err != nil {
+		return nil, err
+	}
+	if verdict == nil {
+		return ParseVerdict(res)
+	}
+	return verdict, nil
+}
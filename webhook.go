@@ -0,0 +1,190 @@
+package shadowd
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// The header carrying the HMAC-SHA256 of a webhook body, "sha256=<hex>".
+const WEBHOOK_SIGNATURE_HEADER = "X-Shadowd-Signature"
+
+// Default WebhookNotifier settings, used when the matching field is zero.
+const (
+	WEBHOOK_DEFAULT_WINDOW  = 10 * time.Second
+	WEBHOOK_DEFAULT_DEDUP   = 5 * time.Minute
+	WEBHOOK_DEFAULT_RETRIES = 3
+)
+
+// The json body posted by a WebhookNotifier without a Template.
+type WebhookBatch struct {
+	Profile string   `json:"profile"`
+	Count   int      `json:"count"`
+	Events  []*Event `json:"events"`
+}
+
+// A Sink posting events with a status of at least MinStatus (by default
+// only STATUS_CRITICAL_ATTACK) to every URL.
+// Events are collected for Window and sent as one batch, a client IP that
+// was already reported within DedupWindow is not reported again.
+// The body is a json WebhookBatch, or the result of executing Template with
+// the WebhookBatch when set. Failed posts are retried up to MaxRetries times
+// with an exponential backoff. With a Secret every post carries a
+// WEBHOOK_SIGNATURE_HEADER. The inputs of the events are never sent.
+type WebhookNotifier struct {
+	URLs        []string
+	Profile     string
+	MinStatus   int
+	Window      time.Duration
+	DedupWindow time.Duration
+	Template    *template.Template
+	ContentType string
+	Secret      string
+	MaxRetries  int
+	Client      *http.Client
+
+	mutex    sync.Mutex
+	pending  []*Event
+	reported map[string]time.Time
+	timer    *time.Timer
+}
+
+// Returns a WebhookNotifier posting to the urls with the default settings.
+func NewWebhookNotifier(urls ...string) *WebhookNotifier {
+	return &WebhookNotifier{URLs: urls}
+}
+
+// Queues matching events for the next batch.
+func (notifier *WebhookNotifier) HandleEvent(event *Event) {
+	minStatus := notifier.MinStatus
+	if minStatus == 0 {
+		minStatus = STATUS_CRITICAL_ATTACK
+	}
+	if event.Status < minStatus {
+		return
+	}
+	dedup := notifier.DedupWindow
+	if dedup <= 0 {
+		dedup = WEBHOOK_DEFAULT_DEDUP
+	}
+	now := time.Now()
+
+	notifier.mutex.Lock()
+	defer notifier.mutex.Unlock()
+	if notifier.reported == nil {
+		notifier.reported = make(map[string]time.Time)
+	}
+	if last, ok := notifier.reported[event.ClientIP]; ok && now.Sub(last) < dedup {
+		return
+	}
+	for ip, last := range notifier.reported {
+		if now.Sub(last) >= dedup {
+			delete(notifier.reported, ip)
+		}
+	}
+	notifier.reported[event.ClientIP] = now
+
+	record := *event
+	record.Inputs = nil
+	notifier.pending = append(notifier.pending, &record)
+	if notifier.timer == nil {
+		window := notifier.Window
+		if window <= 0 {
+			window = WEBHOOK_DEFAULT_WINDOW
+		}
+		notifier.timer = time.AfterFunc(window, notifier.Flush)
+	}
+}
+
+// Sends the pending events now.
+func (notifier *WebhookNotifier) Flush() {
+	notifier.mutex.Lock()
+	events := notifier.pending
+	notifier.pending = nil
+	if notifier.timer != nil {
+		notifier.timer.Stop()
+		notifier.timer = nil
+	}
+	notifier.mutex.Unlock()
+	if len(events) == 0 {
+		return
+	}
+
+	batch := &WebhookBatch{Profile: notifier.Profile, Count: len(events), Events: events}
+	body, contentType, err := notifier.body(batch)
+	if err != nil {
+		fmt.Println("Error building the webhook body:", err)
+		return
+	}
+	for _, url := range notifier.URLs {
+		go notifier.post(url, body, contentType)
+	}
+}
+
+func (notifier *WebhookNotifier) body(batch *WebhookBatch) ([]byte, string, error) {
+	if notifier.Template == nil {
+		body, err := json.Marshal(batch)
+		return body, "application/json", err
+	}
+	var buf bytes.Buffer
+	err := notifier.Template.Execute(&buf, batch)
+	contentType := notifier.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	return buf.Bytes(), contentType, err
+}
+
+func (notifier *WebhookNotifier) post(url string, body []byte, contentType string) {
+	client := notifier.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	retries := notifier.MaxRetries
+	if retries <= 0 {
+		retries = WEBHOOK_DEFAULT_RETRIES
+	}
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		err := notifier.postOnce(client, url, body, contentType)
+		if err == nil {
+			return
+		}
+		if attempt >= retries {
+			fmt.Println("Giving up on webhook", url, "after", attempt+1, "attempts:", err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (notifier *WebhookNotifier) postOnce(client *http.Client, url string, body []byte, contentType string) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "go-shadowd/"+VERSION)
+	if notifier.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(notifier.Secret))
+		mac.Write(body)
+		req.Header.Set(WEBHOOK_SIGNATURE_HEADER, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("webhook replied %s", res.Status)
+	}
+	return nil
+}
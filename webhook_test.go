@@ -0,0 +1,154 @@
+package shadowd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"text/template"
+	"time"
+)
+
+type webhookPost struct {
+	body      []byte
+	header    http.Header
+	attempted int32
+}
+
+// Starts a webhook receiver answering the first failures posts with a 503.
+func startWebhookServer(t *testing.T, failures int32) (string, chan webhookPost) {
+	posts := make(chan webhookPost, 10)
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		attempt := atomic.AddInt32(&attempts, 1)
+		if attempt <= failures {
+			res.WriteHeader(503)
+			return
+		}
+		posts <- webhookPost{body: body, header: req.Header, attempted: attempt}
+	}))
+	t.Cleanup(server.Close)
+	return server.URL, posts
+}
+
+func receiveBatch(t *testing.T, posts chan webhookPost) (*WebhookBatch, webhookPost) {
+	select {
+	case post := <-posts:
+		batch := &WebhookBatch{}
+		if err := json.Unmarshal(post.body, batch); err != nil {
+			t.Fatal(err)
+		}
+		return batch, post
+	case <-time.After(5 * time.Second):
+		t.Fatal("no batch received")
+	}
+	return nil, webhookPost{}
+}
+
+func webhookEvent(ip string, status int) *Event {
+	event := testEvent(status)
+	event.ClientIP = ip
+	event.Inputs = map[string]string{"GET|q": "secret"}
+	return event
+}
+
+func TestWebhookNotifierBatches(t *testing.T) {
+	url, posts := startWebhookServer(t, 0)
+	notifier := NewWebhookNotifier(url)
+	notifier.Profile = "1"
+	notifier.Window = 50 * time.Millisecond
+	notifier.Secret = "s3cret"
+
+	notifier.HandleEvent(webhookEvent("192.0.2.1", STATUS_CRITICAL_ATTACK))
+	notifier.HandleEvent(webhookEvent("192.0.2.2", STATUS_ATTACK))
+	notifier.HandleEvent(webhookEvent("192.0.2.3", STATUS_CRITICAL_ATTACK))
+	notifier.HandleEvent(webhookEvent("192.0.2.1", STATUS_CRITICAL_ATTACK))
+
+	batch, post := receiveBatch(t, posts)
+	if batch.Profile != "1" || batch.Count != 2 || len(batch.Events) != 2 ||
+		batch.Events[0].ClientIP != "192.0.2.1" || batch.Events[1].ClientIP != "192.0.2.3" {
+		t.Errorf("unexpected batch %+v", batch)
+	}
+	for _, event := range batch.Events {
+		if event.Inputs != nil {
+			t.Errorf("inputs sent in %+v", event)
+		}
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(post.body)
+	if got, want := post.header.Get(WEBHOOK_SIGNATURE_HEADER), "sha256="+hex.EncodeToString(mac.Sum(nil)); got != want {
+		t.Errorf("got signature %q, want %q", got, want)
+	}
+	if got := post.header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("got content type %q", got)
+	}
+
+	// the duplicate client is still within the dedup window
+	notifier.HandleEvent(webhookEvent("192.0.2.1", STATUS_CRITICAL_ATTACK))
+	notifier.HandleEvent(webhookEvent("192.0.2.4", STATUS_CRITICAL_ATTACK))
+	notifier.Flush()
+	if batch, _ := receiveBatch(t, posts); batch.Count != 1 || batch.Events[0].ClientIP != "192.0.2.4" {
+		t.Errorf("unexpected batch %+v", batch)
+	}
+	select {
+	case post := <-posts:
+		t.Errorf("unexpected post %s", post.body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebhookNotifierDedupWindow(t *testing.T) {
+	url, posts := startWebhookServer(t, 0)
+	notifier := &WebhookNotifier{URLs: []string{url}, DedupWindow: 20 * time.Millisecond, MinStatus: STATUS_ATTACK}
+	notifier.HandleEvent(webhookEvent("192.0.2.1", STATUS_ATTACK))
+	notifier.Flush()
+	receiveBatch(t, posts)
+	time.Sleep(30 * time.Millisecond)
+	notifier.HandleEvent(webhookEvent("192.0.2.1", STATUS_ATTACK))
+	notifier.Flush()
+	if batch, _ := receiveBatch(t, posts); batch.Count != 1 {
+		t.Errorf("client not reported again after the dedup window: %+v", batch)
+	}
+	if len(posts) != 0 {
+		t.Errorf("unexpected posts")
+	}
+}
+
+func TestWebhookNotifierRetries(t *testing.T) {
+	url, posts := startWebhookServer(t, 1)
+	notifier := &WebhookNotifier{URLs: []string{url}, MaxRetries: 1}
+	notifier.HandleEvent(webhookEvent("192.0.2.1", STATUS_CRITICAL_ATTACK))
+	notifier.Flush()
+	batch, post := receiveBatch(t, posts)
+	if post.attempted != 2 || batch.Count != 1 {
+		t.Errorf("got %+v on attempt %d, want the batch on the retry", batch, post.attempted)
+	}
+	if post.header.Get(WEBHOOK_SIGNATURE_HEADER) != "" {
+		t.Errorf("signed without a secret")
+	}
+}
+
+func TestWebhookNotifierTemplate(t *testing.T) {
+	url, posts := startWebhookServer(t, 0)
+	notifier := &WebhookNotifier{
+		URLs:        []string{url},
+		Template:    template.Must(template.New("").Parse(`{{.Count}} attacks from {{range .Events}}{{.ClientIP}}{{end}}`)),
+		ContentType: "text/plain",
+	}
+	notifier.HandleEvent(webhookEvent("192.0.2.1", STATUS_CRITICAL_ATTACK))
+	notifier.Flush()
+	select {
+	case post := <-posts:
+		if string(post.body) != "1 attacks from 192.0.2.1" || post.header.Get("Content-Type") != "text/plain" {
+			t.Errorf("got %q as %s", post.body, post.header.Get("Content-Type"))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no post received")
+	}
+}
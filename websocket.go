@@ -0,0 +1,331 @@
+package shadowd
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// The close codes sent by the WebSocketInspector.
+const (
+	WEBSOCKET_PROTOCOL_ERROR   = 1002
+	WEBSOCKET_POLICY_VIOLATION = 1008
+	WEBSOCKET_MESSAGE_TOO_BIG  = 1009
+	WEBSOCKET_INTERNAL_ERROR   = 1011
+)
+
+// The MaxMessage used when it is zero.
+const WEBSOCKET_DEFAULT_MAX_MESSAGE = 1 << 20
+
+var ErrWebSocketClosed = errors.New("shadowd: websocket closed by the inspector")
+
+// Inspects the messages a client sends over a WebSocket connection, for
+// handlers that hijack the connection after the upgrade such as the
+// httputil.ReverseProxy. Wrap the proxy with Handler, inside the
+// Middleware so the upgrade request itself is analysed first.
+//
+// Fragmented messages are reassembled and held back until shadowd analysed
+// them. Every text message is sent as the WEBSOCKET|message input, or with
+// JSON set JSON objects and arrays as one input per field, such as
+// WEBSOCKET|user|name. The caller and resource are the ones of the upgrade
+// request. Binary messages and control frames are forwarded unchecked.
+//
+// On an attack verdict the client is sent a close frame with
+// WEBSOCKET_POLICY_VIOLATION and the connection is closed. Frames breaking
+// the protocol in a way that could hide a message from the inspection,
+// such as unmasked frames, reserved opcodes and bits, fragmented control
+// frames or a new message starting before the fragments of the previous
+// one ended, close it with WEBSOCKET_PROTOCOL_ERROR. Messages larger
+// than MaxMessage close it with WEBSOCKET_MESSAGE_TOO_BIG and messages
+// that could not be analysed, with any other verdict than STATUS_OK, with
+// WEBSOCKET_INTERNAL_ERROR.
+// The compression extension is not offered to the upstream, so messages
+// are readable.
+type WebSocketInspector struct {
+	Conn       *ShadowdConn
+	MaxMessage int
+	JSON       bool
+}
+
+// Returns true if the request asks for an upgrade to the WebSocket protocol.
+func IsWebSocketUpgrade(req *http.Request) bool {
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, value := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Wraps next so the WebSocket connections it hijacks are inspected.
+func (inspector *WebSocketInspector) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if !IsWebSocketUpgrade(req) {
+			next.ServeHTTP(res, req)
+			return
+		}
+		req.Header.Del("Sec-Websocket-Extensions")
+		next.ServeHTTP(&wsResponseWriter{ResponseWriter: res, inspector: inspector, req: req}, req)
+	})
+}
+
+func (inspector *WebSocketInspector) maxMessage() int {
+	if inspector.MaxMessage > 0 {
+		return inspector.MaxMessage
+	}
+	return WEBSOCKET_DEFAULT_MAX_MESSAGE
+}
+
+// Returns the close code for the message or zero to forward it.
+func (inspector *WebSocketInspector) check(req *http.Request, message []byte) int {
+	inputs := make(map[string]string)
+	var value interface{}
+	if inspector.JSON && json.Unmarshal(message, &value) == nil {
+		switch v := value.(type) {
+		case map[string]interface{}, []interface{}:
+			flattenJSON("WEBSOCKET", v, inputs)
+		}
+	}
+	if len(inputs) == 0 {
+		inputs["WEBSOCKET|message"] = string(message)
+	}
+
+	meta := Meta{
+		ClientIP: ClientIP(req),
+		Caller:   inspector.Conn.Caller(req),
+		Resource: inspector.Conn.Resource(req),
+	}
+	verdict, err := inspector.Conn.CheckInputs(context.WithoutCancel(req.Context()), meta, inputs)
+	switch {
+	case err != nil:
+		fmt.Println("Error analysing a websocket message:", err)
+		if !inspector.Conn.Observe {
+			return WEBSOCKET_INTERNAL_ERROR
+		}
+	case verdict.IsAttack():
+		if inspector.Conn.Observe {
+			fmt.Println("Websocket attack from", meta.ClientIP, "on", meta.Caller, "threats:", verdict.Threats)
+		} else {
+			return WEBSOCKET_POLICY_VIOLATION
+		}
+	case verdict.Status != STATUS_OK:
+		fmt.Println("Websocket message from", meta.ClientIP, "on", meta.Caller, "not analysed, status", verdict.Status)
+		if !inspector.Conn.Observe {
+			return WEBSOCKET_INTERNAL_ERROR
+		}
+	}
+	return 0
+}
+
+type wsResponseWriter struct {
+	http.ResponseWriter
+	inspector *WebSocketInspector
+	req       *http.Request
+}
+
+func (w *wsResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	wsconn := &wsConn{Conn: conn, inspector: w.inspector, req: w.req, reader: brw.Reader}
+	// The handler writes the upgrade response through brw, before any frame.
+	return wsconn, bufio.NewReadWriter(bufio.NewReader(wsconn), brw.Writer), nil
+}
+
+func (w *wsResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// A hijacked connection returning the frames of the client once checked.
+type wsConn struct {
+	net.Conn
+	inspector *WebSocketInspector
+	req       *http.Request
+	reader    *bufio.Reader
+
+	out     []byte // checked frames not read yet
+	held    []byte // frames of the incomplete message
+	message []byte // unmasked payload of the incomplete message
+	text    bool
+	err     error
+
+	writeMutex sync.Mutex
+	written    frameTracker
+	closing    bool
+}
+
+func (conn *wsConn) Read(p []byte) (int, error) {
+	for len(conn.out) == 0 {
+		if conn.err != nil {
+			return 0, conn.err
+		}
+		conn.err = conn.readFrame()
+	}
+	n := copy(p, conn.out)
+	conn.out = conn.out[n:]
+	return n, nil
+}
+
+func (conn *wsConn) Write(p []byte) (int, error) {
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+	if conn.closing {
+		return 0, ErrWebSocketClosed
+	}
+	n, err := conn.Conn.Write(p)
+	conn.written.track(p[:n])
+	return n, err
+}
+
+func (conn *wsConn) CloseWrite() error {
+	if closer, ok := conn.Conn.(interface{ CloseWrite() error }); ok {
+		return closer.CloseWrite()
+	}
+	return conn.Conn.Close()
+}
+
+func (conn *wsConn) readFrame() error {
+	frame := make([]byte, 2, 14)
+	if _, err := io.ReadFull(conn.reader, frame); err != nil {
+		return err
+	}
+	size := frameHeaderSize(frame)
+	frame = frame[:size]
+	if _, err := io.ReadFull(conn.reader, frame[2:]); err != nil {
+		return err
+	}
+	length := framePayloadLength(frame)
+	fin, opcode := frame[0]&0x80 != 0, frame[0]&0x0f
+	control := opcode >= 8
+	fragmented := len(conn.held) > 0
+	switch {
+	case frame[0]&0x70 != 0, frame[1]&0x80 == 0:
+		// reserved bits without extension or an unmasked client frame
+		return conn.close(WEBSOCKET_PROTOCOL_ERROR)
+	case opcode > 10, opcode > 2 && opcode < 8:
+		return conn.close(WEBSOCKET_PROTOCOL_ERROR)
+	case control && (!fin || length > 125):
+		return conn.close(WEBSOCKET_PROTOCOL_ERROR)
+	case !control && (opcode == 0) != fragmented:
+		// a continuation without a message or a message within another
+		return conn.close(WEBSOCKET_PROTOCOL_ERROR)
+	}
+	if length > uint64(conn.inspector.maxMessage()-len(conn.message)) {
+		return conn.close(WEBSOCKET_MESSAGE_TOO_BIG)
+	}
+	frame = append(frame, make([]byte, length)...)
+	if _, err := io.ReadFull(conn.reader, frame[size:]); err != nil {
+		return err
+	}
+
+	if control {
+		conn.out = append(conn.out, frame...)
+		return nil
+	}
+	if opcode != 0 {
+		conn.text = opcode == 1
+		conn.message = conn.message[:0]
+	}
+	mask := frame[size-4 : size]
+	for i, b := range frame[size:] {
+		conn.message = append(conn.message, b^mask[i%4])
+	}
+	conn.held = append(conn.held, frame...)
+	if !fin {
+		return nil
+	}
+	if conn.text {
+		if code := conn.inspector.check(conn.req, conn.message); code != 0 {
+			return conn.close(code)
+		}
+	}
+	conn.out, conn.held = conn.held, nil
+	conn.message = conn.message[:0]
+	return nil
+}
+
+// Sends the client a close frame with the code, unless a frame of the
+// upstream is partly written, and returns the error ending the proxying.
+func (conn *wsConn) close(code int) error {
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+	conn.closing = true
+	if conn.written.atBoundary() {
+		frame := []byte{0x88, 2, 0, 0}
+		binary.BigEndian.PutUint16(frame[2:], uint16(code))
+		conn.Conn.Write(frame)
+	}
+	conn.Conn.Close()
+	return ErrWebSocketClosed
+}
+
+// Follows the frames of a stream so that a frame can be inserted between
+// two of them.
+type frameTracker struct {
+	header    []byte
+	remaining uint64
+}
+
+func (tracker *frameTracker) track(p []byte) {
+	for len(p) > 0 {
+		if tracker.remaining > 0 {
+			n := uint64(len(p))
+			if n > tracker.remaining {
+				n = tracker.remaining
+			}
+			tracker.remaining -= n
+			p = p[n:]
+			continue
+		}
+		tracker.header = append(tracker.header, p[0])
+		p = p[1:]
+		if len(tracker.header) >= 2 && len(tracker.header) == frameHeaderSize(tracker.header) {
+			tracker.remaining = framePayloadLength(tracker.header)
+			tracker.header = tracker.header[:0]
+		}
+	}
+}
+
+func (tracker *frameTracker) atBoundary() bool {
+	return tracker.remaining == 0 && len(tracker.header) == 0
+}
+
+// Returns the size of the frame header from its first two bytes.
+func frameHeaderSize(header []byte) int {
+	size := 2
+	switch header[1] & 0x7f {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	if header[1]&0x80 != 0 {
+		size += 4
+	}
+	return size
+}
+
+func framePayloadLength(header []byte) uint64 {
+	switch length := header[1] & 0x7f; length {
+	case 126:
+		return uint64(binary.BigEndian.Uint16(header[2:4]))
+	case 127:
+		return binary.BigEndian.Uint64(header[2:10])
+	default:
+		return uint64(length)
+	}
+}
@@ -0,0 +1,162 @@
+package shadowd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns a masked client frame.
+func wsFrame(fin bool, opcode byte, payload string) []byte {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	frame := []byte{first, 0x80 | byte(len(payload))}
+	mask := []byte{1, 2, 3, 4}
+	frame = append(frame, mask...)
+	for i := 0; i < len(payload); i++ {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+	return frame
+}
+
+// Starts an inspected upstream recording what it reads from the client and
+// returns its address with the channel receiving the recorded bytes.
+func startWebSocketUpstream(t *testing.T, inspector *WebSocketInspector) (string, chan []byte) {
+	forwarded := make(chan []byte, 1)
+	upstream := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		conn, brw, err := http.NewResponseController(res).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		brw.Flush()
+		data, _ := io.ReadAll(brw)
+		forwarded <- data
+	})
+	server := httptest.NewServer(inspector.Handler(upstream))
+	t.Cleanup(server.Close)
+	return server.Listener.Addr().String(), forwarded
+}
+
+// Sends the frames and returns the close code sent by the inspector, zero
+// when the connection was not closed by it.
+func sendWebSocketFrames(t *testing.T, addr string, frames [][]byte) int {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"))
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 101 {
+		t.Fatalf("got status %d", res.StatusCode)
+	}
+	for _, frame := range frames {
+		conn.Write(frame)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+
+	reply, _ := io.ReadAll(reader)
+	if len(reply) == 4 && reply[0] == 0x88 {
+		return int(binary.BigEndian.Uint16(reply[2:]))
+	}
+	return 0
+}
+
+func TestWebSocketInspector(t *testing.T) {
+	tests := []struct {
+		name      string
+		frames    [][]byte
+		code      int
+		forwarded []int // indexes of the frames the upstream reads, in order
+	}{
+		{"text", [][]byte{wsFrame(true, 1, "hello")}, 0, []int{0}},
+		{"binary", [][]byte{wsFrame(true, 2, "<script>")}, 0, []int{0}},
+		{"fragments", [][]byte{wsFrame(false, 1, "hel"), wsFrame(false, 0, "l"), wsFrame(true, 0, "o")}, 0, []int{0, 1, 2}},
+		{"ping within fragments", [][]byte{wsFrame(false, 1, "hel"), wsFrame(true, 9, "p"), wsFrame(true, 0, "lo")}, 0, []int{1, 0, 2}},
+		{"attack", [][]byte{wsFrame(true, 1, "<script>")}, WEBSOCKET_POLICY_VIOLATION, nil},
+		{"fragmented attack", [][]byte{wsFrame(false, 1, "<scr"), wsFrame(true, 0, "ipt>")}, WEBSOCKET_POLICY_VIOLATION, nil},
+		{"binary within text", [][]byte{wsFrame(false, 1, "<script>"), wsFrame(true, 2, "")}, WEBSOCKET_PROTOCOL_ERROR, nil},
+		{"text within text", [][]byte{wsFrame(false, 1, "<script>"), wsFrame(true, 1, "hi")}, WEBSOCKET_PROTOCOL_ERROR, nil},
+		{"continuation first", [][]byte{wsFrame(true, 0, "<script>")}, WEBSOCKET_PROTOCOL_ERROR, nil},
+		{"reserved opcode", [][]byte{wsFrame(true, 3, "<script>")}, WEBSOCKET_PROTOCOL_ERROR, nil},
+		{"reserved control opcode", [][]byte{wsFrame(true, 11, "x")}, WEBSOCKET_PROTOCOL_ERROR, nil},
+		{"fragmented ping", [][]byte{wsFrame(false, 9, "x")}, WEBSOCKET_PROTOCOL_ERROR, nil},
+		{"reserved bit", [][]byte{append([]byte{0xc1}, wsFrame(true, 1, "<script>")[1:]...)}, WEBSOCKET_PROTOCOL_ERROR, nil},
+		{"unmasked", [][]byte{append([]byte{0x81, 8}, "<script>"...)}, WEBSOCKET_PROTOCOL_ERROR, nil},
+		{"bad request", [][]byte{wsFrame(true, 1, "status=2")}, WEBSOCKET_INTERNAL_ERROR, nil},
+		{"bad signature", [][]byte{wsFrame(true, 1, "status=3")}, WEBSOCKET_INTERNAL_ERROR, nil},
+		{"bad json", [][]byte{wsFrame(true, 1, "status=4")}, WEBSOCKET_INTERNAL_ERROR, nil},
+		{"too big", [][]byte{wsFrame(false, 1, strings.Repeat("a", 40)), wsFrame(true, 0, strings.Repeat("a", 40))}, WEBSOCKET_MESSAGE_TOO_BIG, nil},
+	}
+	for _, test := range tests {
+		transport := &recordingTransport{reply: `{"status":1}`}
+		inspector := &WebSocketInspector{
+			Conn:       &ShadowdConn{ProfileId: "1", ProfileKey: "k", Transport: &wsTransport{transport}},
+			MaxMessage: 64,
+		}
+		addr, forwarded := startWebSocketUpstream(t, inspector)
+		code := sendWebSocketFrames(t, addr, test.frames)
+		if code != test.code {
+			t.Errorf("%s: got close code %d, want %d", test.name, code, test.code)
+		}
+		var want []byte
+		for _, i := range test.forwarded {
+			want = append(want, test.frames[i]...)
+		}
+		if data := <-forwarded; !bytes.Equal(data, want) {
+			t.Errorf("%s: forwarded %q, want %q", test.name, data, want)
+		}
+	}
+}
+
+func TestWebSocketInspectorObserve(t *testing.T) {
+	for _, message := range []string{"<script>", "status=3"} {
+		inspector := &WebSocketInspector{
+			Conn: &ShadowdConn{ProfileId: "1", ProfileKey: "k", Observe: true, Transport: &wsTransport{&recordingTransport{}}},
+		}
+		addr, forwarded := startWebSocketUpstream(t, inspector)
+		frame := wsFrame(true, 1, message)
+		if code := sendWebSocketFrames(t, addr, [][]byte{frame}); code != 0 {
+			t.Errorf("%s: got close code %d in observe mode", message, code)
+		}
+		if data := <-forwarded; !bytes.Equal(data, frame) {
+			t.Errorf("%s: forwarded %q, want %q", message, data, frame)
+		}
+	}
+}
+
+// Flags the messages containing "<script>" and replies with status n to
+// the messages containing "status=n".
+type wsTransport struct {
+	*recordingTransport
+}
+
+func (transport *wsTransport) Send(ctx context.Context, payload *SignedPayload) (string, error) {
+	transport.recordingTransport.Send(ctx, payload)
+	if bytes.Contains(payload.Data, []byte("\\u003cscript\\u003e")) {
+		return `{"status":5,"threats":["WEBSOCKET|message"]}`, nil
+	}
+	if i := bytes.Index(payload.Data, []byte("status=")); i >= 0 {
+		return `{"status":` + string(payload.Data[i+7]) + `}`, nil
+	}
+	return `{"status":1}`, nil
+}